@@ -0,0 +1,582 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"sort"
+)
+
+// warning ...
+// A likely mistake found by checkProgram on line index
+type warning struct {
+	index   int
+	message string
+}
+
+// edge ...
+// A way execution can go from one line to another. gen are the variables
+// which are assigned on the way, e.g. the parameters of a SUB.
+type edge struct {
+	to  int
+	gen []string
+}
+
+// checker ...
+// The state of checkProgram. in holds, for each line which can be reached,
+// the variables which are certainly assigned before it runs.
+type checker struct {
+	prog        []*Line
+	warnings    []warning
+	edges       map[int][]edge
+	returnSites []int
+	callSites   map[string][]int
+	owner       map[int]string
+	entry       int
+	entries     []int
+	computed    bool
+	in          map[int]map[string]bool
+}
+
+// checkProgram ...
+// Looks for likely mistakes in a program without running it: jumps to lines
+// which don't exist, lines which can never run, variables which are read
+// before they're assigned or assigned and never read, and comparisons between
+// strings and integers. Uses indexProcedures and indexLabels, so the program
+// must have been parsed successfully.
+func checkProgram(prog []*Line) []warning {
+	c := &checker{prog: prog, edges: make(map[int][]edge), callSites: make(map[string][]int),
+		owner: make(map[int]string)}
+	if err := indexProcedures(prog); err != nil {
+		return []warning{lineWarning(err)}
+	}
+	if err := indexLabels(prog); err != nil {
+		return []warning{lineWarning(err)}
+	}
+
+	c.findOwners()
+	c.addFlow(buildFlow(prog))
+	c.addReturns()
+	c.flow()
+	c.checkUnreachable()
+	c.checkUnread()
+	c.checkComparisons()
+
+	sort.SliceStable(c.warnings, func(i, j int) bool { return c.warnings[i].index < c.warnings[j].index })
+	return c.warnings
+}
+
+// lineWarning ...
+// Turns the lineError from indexProcedures or indexLabels into a warning on
+// the line it's about.
+func lineWarning(err error) warning {
+	le := err.(lineError)
+	return warning{le.index, le.err.Error()}
+}
+
+func (c *checker) warn(index int, format string, args ...interface{}) {
+	c.warnings = append(c.warnings, warning{index, fmt.Sprintf(format, args...)})
+}
+
+func (c *checker) addEdge(from, to int, gen []string) {
+	if to >= 0 && c.prog[to] != nil && c.prog[to].Used {
+		c.edges[from] = append(c.edges[from], edge{to, gen})
+	}
+}
+
+// findOwners ...
+// Notes which procedure each line of a SUB or FUNCTION belongs to.
+func (c *checker) findOwners() {
+	for name, proc := range procedures {
+		end, err := skipProcedure(c.prog, proc.start)
+		if err != nil {
+			c.warn(proc.start, "%s", err.Error())
+			continue
+		}
+		for i := proc.start + 1; i <= end; i++ {
+			c.owner[i] = name
+		}
+	}
+}
+
+// entryGen ...
+// Returns the variables assigned on entry to a procedure.
+func entryGen(name string) []string {
+	gen := []string{}
+	for _, param := range procedures[name].params {
+		gen = append(gen, param.StringData)
+	}
+	if procedures[name].function {
+		gen = append(gen, name)
+	}
+	return gen
+}
+
+// addFlow ...
+// Adds the edges of the control flow graph which ez dot draws. GOSUB and
+// CALL don't go on to the next line here: RETURN and END SUB go there
+// instead, so that what the subroutine assigns is known afterwards. The body
+// of each TEST is checked as if it were a program.
+func (c *checker) addFlow(g *flowGraph) {
+	c.entry = g.entry
+	c.warnings = append(c.warnings, g.warnings...)
+	for _, e := range g.edges {
+		switch e.kind {
+		case flowComputed:
+			c.computed = true
+		case flowReturn:
+			if e.proc == "" {
+				c.returnSites = append(c.returnSites, e.to)
+			} else {
+				c.callSites[e.proc] = append(c.callSites[e.proc], e.to)
+			}
+		case flowCall, flowFunction:
+			c.addEdge(e.from, e.to, entryGen(e.proc))
+		default:
+			c.addEdge(e.from, e.to, nil)
+		}
+	}
+	for i, line := range c.prog {
+		if line != nil && line.Used && line.Tokens[0].Type == TokenTest {
+			c.entries = append(c.entries, i)
+		}
+	}
+}
+
+// addReturns ...
+// RETURN can go back to the line after any GOSUB, and END SUB to the line
+// after any CALL of its SUB. A FUNCTION returns into the middle of a line,
+// which carries on to the next line anyway.
+func (c *checker) addReturns() {
+	for i, line := range c.prog {
+		if line == nil || !line.Used {
+			continue
+		}
+		for _, l := range statements(line.Tokens) {
+			switch l[0].Type {
+			case TokenReturn:
+				for _, site := range c.returnSites {
+					c.addEdge(i, site, nil)
+				}
+			case TokenEndSub, TokenExitSub:
+				for _, site := range c.callSites[c.owner[i]] {
+					c.addEdge(i, site, nil)
+				}
+			}
+		}
+	}
+}
+
+// flow ...
+// Works out which variables are certainly assigned before each line runs,
+// starting from nothing at the first line, then warns about variables read
+// before then.
+func (c *checker) flow() {
+	c.in = make(map[int]map[string]bool)
+	work := []int{}
+	for _, start := range append([]int{c.entry}, c.entries...) {
+		if start != -1 {
+			c.in[start] = map[string]bool{}
+			work = append(work, start)
+		}
+	}
+	for len(work) > 0 {
+		i := work[len(work)-1]
+		work = work[:len(work)-1]
+		out := c.transfer(c.prog[i].Tokens, copySet(c.in[i]), nil)
+		for _, e := range c.edges[i] {
+			next := copySet(out)
+			for _, name := range e.gen {
+				next[name] = true
+			}
+			if old, ok := c.in[e.to]; ok {
+				next = intersect(old, next)
+				if len(next) == len(old) {
+					continue
+				}
+			}
+			c.in[e.to] = next
+			work = append(work, e.to)
+		}
+	}
+
+	reported := make(map[string]bool)
+	for i, line := range c.prog {
+		if in, ok := c.in[i]; ok {
+			c.transfer(line.Tokens, copySet(in), func(t Token, assigned bool) {
+				if !assigned && !reported[t.StringData] {
+					reported[t.StringData] = true
+					c.warn(i, "%s is read before anything is assigned to it", t.StringData)
+				}
+			})
+		}
+	}
+}
+
+// transfer ...
+// Adds the variables which the statement l certainly assigns to set, calling
+// reads for each variable it reads, with whether it's in set by then.
+func (c *checker) transfer(l []Token, set map[string]bool, reads func(t Token, assigned bool)) map[string]bool {
+	read := func(t Token) {
+		if reads != nil {
+			reads(t, set[t.StringData])
+		}
+	}
+	access := func(t Token, write bool) {
+		if write {
+			set[t.StringData] = true
+		} else {
+			read(t)
+		}
+	}
+
+	switch l[0].Type {
+	case TokenIf:
+		thenPos, elsePos := ifParts(l)
+		variables(l[1:thenPos], access)
+		if elsePos == -1 {
+			c.transfer(l[thenPos+1:], copySet(set), reads)
+			return set
+		}
+		then := c.transfer(l[thenPos+1:elsePos], copySet(set), reads)
+		otherwise := c.transfer(l[elsePos+1:], copySet(set), reads)
+		return intersect(then, otherwise)
+	case TokenLet:
+		for _, clause := range letClauses(l) {
+			if len(clause) > 1 && clause[1].Type == TokenEq {
+				variables(clause[2:], access)
+			} else if len(clause) > 1 {
+				variables(clause, access)
+			}
+			if len(clause) > 1 {
+				set[clause[0].StringData] = true
+			}
+		}
+	case TokenInput:
+		variables(l[1:2], access)
+		set[l[2].StringData] = true
+	case TokenLocal:
+		for _, t := range l[1:] {
+			if t.Type == TokenIdentInt || t.Type == TokenIdentStr {
+				set[t.StringData] = true
+			}
+		}
+	case TokenGoto, TokenGosub:
+		if _, ok := labels[l[0].StringData]; l[0].StringData != "" && !ok {
+			read(Token{Type: TokenIdentInt, StringData: l[0].StringData})
+		}
+	case TokenCallSub:
+		variables([]Token{{Type: TokenCall, StringData: l[0].StringData, Args: l[0].Args}}, access)
+	case TokenDef, TokenSubroutine, TokenFunction:
+		// Parameters are assigned when called, and DEF FN bodies run later
+	default:
+		variables(l[1:], access)
+	}
+	return set
+}
+
+// checkUnreachable ...
+// Warns about lines which nothing leads to. A GOTO to a line number stored in
+// a variable could lead anywhere, so then nothing is reported.
+func (c *checker) checkUnreachable() {
+	if c.computed {
+		return
+	}
+	first := -1
+	last := -1
+	report := func() {
+		if first == last {
+			c.warn(first, "Line %d can never run", first)
+		} else {
+			c.warn(first, "Lines %d-%d can never run", first, last)
+		}
+	}
+	for i, line := range c.prog {
+		if line == nil || !line.Used {
+			continue
+		}
+		_, ok := c.in[i]
+		switch line.Tokens[0].Type {
+		case TokenSubroutine, TokenFunction, TokenTest:
+			// Declarations don't need to be run
+			ok = true
+		}
+		if ok {
+			if first != -1 {
+				report()
+				first = -1
+			}
+			continue
+		}
+		if first == -1 {
+			first = i
+		}
+		last = i
+	}
+	if first != -1 {
+		report()
+	}
+}
+
+// checkUnread ...
+// Warns about variables which are assigned by LET or INPUT, but never read
+// anywhere. A FUNCTION returns the value assigned to its name, so that
+// doesn't count.
+func (c *checker) checkUnread() {
+	read := make(map[string]bool)
+	written := make(map[string]int)
+	order := []string{}
+	for i, line := range c.prog {
+		if line == nil || !line.Used {
+			continue
+		}
+		for _, l := range statements(line.Tokens) {
+			targets := []Token{}
+			switch l[0].Type {
+			case TokenLet:
+				for _, clause := range letClauses(l) {
+					if len(clause) > 1 {
+						targets = append(targets, clause[0])
+					}
+				}
+			case TokenInput:
+				targets = append(targets, l[2])
+			}
+			for _, t := range targets {
+				if _, ok := written[t.StringData]; !ok {
+					written[t.StringData] = i
+					order = append(order, t.StringData)
+				}
+			}
+		}
+		c.transfer(line.Tokens, map[string]bool{}, func(t Token, assigned bool) { read[t.StringData] = true })
+		if line.Tokens[0].Type == TokenDef {
+			variables(line.Tokens[1:], func(t Token, write bool) { read[t.StringData] = true })
+		}
+	}
+
+	for _, name := range order {
+		if _, proc := procedures[name]; !read[name] && !proc {
+			c.warn(written[name], "%s is assigned but never read", name)
+		}
+	}
+}
+
+// checkComparisons ...
+// Warns about comparisons between a string and an integer, which compare the
+// length of the string, in IF statements and in the CASEs of a SELECT.
+func (c *checker) checkComparisons() {
+	selects := []bool{}
+	for i, line := range c.prog {
+		if line == nil || !line.Used {
+			continue
+		}
+		l := line.Tokens
+		switch l[0].Type {
+		case TokenSelect:
+			selects = append(selects, exprIsStr(l[1:]))
+			continue
+		case TokenEndSelect:
+			if len(selects) > 0 {
+				selects = selects[:len(selects)-1]
+			}
+			continue
+		case TokenCase:
+			if len(selects) == 0 {
+				continue
+			}
+			for _, clause := range splitTokens(l[1:], TokenComma) {
+				for _, part := range caseOperands(clause) {
+					if len(part) > 0 && exprIsStr(part) != selects[len(selects)-1] {
+						c.warn(i, "CASE compares a string with an integer, which uses the length of the string")
+					}
+				}
+			}
+			continue
+		}
+
+		for _, s := range statements(l) {
+			if s[0].Type != TokenIf {
+				continue
+			}
+			thenPos, _ := ifParts(s)
+			pred := s[1:thenPos]
+			for j, t := range pred {
+				if isComparisonType(t.Type) && j > 0 && j < len(pred)-1 && exprIsStr(pred[:j]) != exprIsStr(pred[j+1:]) {
+					c.warn(i, "IF compares a string with an integer, which uses the length of the string")
+					break
+				}
+			}
+		}
+	}
+}
+
+// caseOperands ...
+// Returns the expressions in one clause of a CASE: the right of CASE IS, both
+// ends of a range, or a single value.
+func caseOperands(clause []Token) [][]Token {
+	if len(clause) > 2 && clause[0].Type == TokenIs {
+		return [][]Token{clause[2:]}
+	}
+	return splitTokens(clause, TokenTo)
+}
+
+// exprIsStr ...
+// Whether an expression gives a string, which is decided by its first operand.
+func exprIsStr(l []Token) bool {
+	if len(l) == 0 {
+		return false
+	}
+	switch l[0].Type {
+	case TokenIdentStr, TokenConstStr:
+		return true
+	case TokenCall:
+		_, stringp := validIdentifierStrP(l[0].StringData)
+		return stringp
+	}
+	return false
+}
+
+// ifParts ...
+// Returns the positions of THEN and ELSE in an IF statement, or -1 for ELSE
+// if there isn't one.
+func ifParts(l []Token) (int, int) {
+	thenPos, elsePos := -1, -1
+	for i, t := range l {
+		if t.Type == TokenThen {
+			thenPos = i
+		} else if t.Type == TokenElse {
+			elsePos = i
+		}
+	}
+	return thenPos, elsePos
+}
+
+// statements ...
+// Returns a statement, and the statements after THEN and ELSE if it's an IF.
+func statements(l []Token) [][]Token {
+	ret := [][]Token{l}
+	if l[0].Type == TokenIf {
+		thenPos, elsePos := ifParts(l)
+		if elsePos == -1 {
+			return append(ret, statements(l[thenPos+1:])...)
+		}
+		ret = append(ret, statements(l[thenPos+1:elsePos])...)
+		ret = append(ret, statements(l[elsePos+1:])...)
+	}
+	return ret
+}
+
+// splitTokens ...
+// Splits l at each token of type sep.
+func splitTokens(l []Token, sep TokenType) [][]Token {
+	ret := [][]Token{}
+	start := 0
+	for i, t := range l {
+		if t.Type == sep {
+			ret = append(ret, l[start:i])
+			start = i + 1
+		}
+	}
+	return append(ret, l[start:])
+}
+
+// letClauses ...
+// Returns the assignments of a LET statement.
+func letClauses(l []Token) [][]Token {
+	ret := [][]Token{}
+	for _, clause := range splitTokens(l[1:], TokenFieldSep) {
+		if len(clause) > 0 {
+			ret = append(ret, clause)
+		}
+	}
+	return ret
+}
+
+// calls ...
+// Returns the calls in l, including those inside the arguments of others.
+func calls(l []Token) []Token {
+	ret := []Token{}
+	for _, t := range l {
+		if t.Type == TokenCall {
+			ret = append(ret, t)
+		}
+		for _, arg := range t.Args {
+			ret = append(ret, calls(arg)...)
+		}
+	}
+	return ret
+}
+
+// variables ...
+// Calls fn for each variable in the expressions in l, in order. A variable
+// passed to a BYREF parameter may be assigned, so it's passed as a write.
+func variables(l []Token, fn func(t Token, write bool)) {
+	for _, t := range l {
+		switch t.Type {
+		case TokenIdentInt, TokenIdentStr:
+			fn(t, false)
+		case TokenCall:
+			proc := procedures[t.StringData]
+			for i, arg := range t.Args {
+				if proc != nil && i < len(proc.byref) && proc.byref[i] && len(arg) == 1 {
+					fn(arg[0], true)
+				} else {
+					variables(arg, fn)
+				}
+			}
+		}
+	}
+}
+
+func copySet(set map[string]bool) map[string]bool {
+	ret := make(map[string]bool, len(set))
+	for k := range set {
+		ret[k] = true
+	}
+	return ret
+}
+
+func intersect(a, b map[string]bool) map[string]bool {
+	ret := make(map[string]bool)
+	for k := range a {
+		if b[k] {
+			ret[k] = true
+		}
+	}
+	return ret
+}
+
+// checkCommand ...
+// ez check file... reports the problems in programs without running them,
+// and exits with status 1 if there are any.
+func checkCommand(files []string) {
+	if len(files) == 0 {
+		fmt.Fprintln(os.Stderr, "Usage: ez check file...")
+		os.Exit(2)
+	}
+
+	problems := 0
+	for _, name := range files {
+		file, err := os.Open(name)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err.Error())
+			problems++
+			continue
+		}
+		prog, errs := parseProgram(file)
+		file.Close()
+
+		reportParseErrors(os.Stdout, name, errs)
+		problems += len(errs)
+		if len(errs) > 0 {
+			continue
+		}
+		for _, w := range checkProgram(prog) {
+			fmt.Printf("%s:%d: %d: %s\n", name, prog[w.index].Source, w.index, w.message)
+			problems++
+		}
+	}
+	if problems > 0 {
+		os.Exit(1)
+	}
+}
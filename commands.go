@@ -0,0 +1,262 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// renumCommand ...
+// RENUM [new-start[, increment[, old-start]]]
+func renumCommand(args []string) {
+	params := []int{AutoStep, AutoStep, 0}
+	if text := strings.TrimSpace(strings.Join(args, " ")); text != "" {
+		for i, arg := range splitCommas(text) {
+			if i >= len(params) {
+				fmt.Println("Usage: RENUM [new-start[, increment[, old-start]]]")
+				return
+			}
+			num, err := strconv.Atoi(arg)
+			if err != nil {
+				fmt.Printf("Bad number \"%s\": %s\n", arg, err.Error())
+				return
+			}
+			params[i] = num
+		}
+	}
+
+	n, err := renumber(params[0], params[1], params[2])
+	if err != nil {
+		fmt.Println(err.Error())
+		return
+	}
+	fmt.Printf("Renumbered %d lines\n", n)
+}
+
+// fileArg ...
+// Gets the file name given to a command such as SAVE "file"
+func fileArg(args []string) (string, error) {
+	name := strings.TrimSpace(strings.Join(args, " "))
+	if len(name) >= 2 && name[0] == '"' && name[len(name)-1] == '"' {
+		name = name[1 : len(name)-1]
+	}
+	if name == "" {
+		return "", fmt.Errorf("Expected a file name")
+	}
+	return name, nil
+}
+
+// parseRange ...
+// Parses a range of line numbers: N, N-M, -M or N-
+func parseRange(text string) (int, int, error) {
+	text = strings.TrimSpace(text)
+	if text == "" {
+		return 0, MaxLines - 1, nil
+	}
+
+	from, to := text, text
+	if dash := strings.Index(text, "-"); dash != -1 {
+		from, to = strings.TrimSpace(text[:dash]), strings.TrimSpace(text[dash+1:])
+	}
+
+	start, end := 0, MaxLines-1
+	var err error
+	if from != "" {
+		start, err = strconv.Atoi(from)
+		if err != nil {
+			return 0, 0, fmt.Errorf("Bad line number \"%s\"", from)
+		}
+	}
+	if to != "" {
+		end, err = strconv.Atoi(to)
+		if err != nil {
+			return 0, 0, fmt.Errorf("Bad line number \"%s\"", to)
+		}
+	}
+	if start < 0 || end >= MaxLines || start > end {
+		return 0, 0, fmt.Errorf("Bad line range %s", text)
+	}
+	return start, end, nil
+}
+
+// listCommand ...
+// LIST [range] ["file"]
+func listCommand(args []string) {
+	text := strings.Join(args, " ")
+	name := ""
+	if quote := strings.Index(text, "\""); quote != -1 {
+		name = strings.Trim(strings.TrimSpace(text[quote:]), "\"")
+		text = text[:quote]
+	}
+	from, to, err := parseRange(text)
+	if err != nil {
+		fmt.Println(err.Error())
+		return
+	}
+
+	if name != "" {
+		file, err := os.Create(name)
+		if err != nil {
+			fmt.Println(err.Error())
+			return
+		}
+		err = listLines(file, from, to)
+		if cerr := file.Close(); err == nil {
+			err = cerr
+		}
+		if err != nil {
+			fmt.Println(err.Error())
+		}
+		return
+	}
+
+	if isTerminal(os.Stdin) && isTerminal(os.Stdout) {
+		err = listLines(newPager(os.Stdout), from, to)
+	} else {
+		err = listLines(os.Stdout, from, to)
+	}
+	if err != nil && err != errStopPaging {
+		fmt.Println(err.Error())
+	}
+}
+
+// editCommand ...
+// EDIT N puts line N in the line editor, ready to be changed and entered again.
+func editCommand(args []string) {
+	if len(args) != 1 {
+		fmt.Println("Usage: EDIT N")
+		return
+	}
+	num, err := strconv.Atoi(args[0])
+	if err != nil {
+		fmt.Printf("Bad line number \"%s\"\n", args[0])
+		return
+	}
+	if num < 0 || MaxLines <= num || lines[num] == nil || !lines[num].Used {
+		fmt.Printf("Line %d doesn't exist\n", num)
+		return
+	}
+	prefill = fmt.Sprintf("%d %s", num, lines[num].Content)
+}
+
+// autoCommand ...
+// AUTO [start[, step]] prompts for lines with line numbers counting up from
+// start, until an empty line is entered or Ctrl-C is pressed.
+func autoCommand(args []string) {
+	params := []int{AutoStep, AutoStep}
+	if text := strings.TrimSpace(strings.Join(args, " ")); text != "" {
+		for i, arg := range splitCommas(text) {
+			if i >= len(params) {
+				fmt.Println("Usage: AUTO [start[, step]]")
+				return
+			}
+			num, err := strconv.Atoi(arg)
+			if err != nil {
+				fmt.Printf("Bad number \"%s\": %s\n", arg, err.Error())
+				return
+			}
+			params[i] = num
+		}
+	}
+	num, step := params[0], params[1]
+	if step <= 0 {
+		fmt.Println("AUTO needs a positive step")
+		return
+	}
+
+	for 0 <= num && num < MaxLines {
+		initial := ""
+		if lines[num] != nil && lines[num].Used {
+			fmt.Printf("Warning: line %d already exists, and will be replaced\n", num)
+			initial = lines[num].Content
+		}
+
+		text, err := promptLine(fmt.Sprintf("%d ", num), initial)
+		if err != nil || strings.TrimSpace(text) == "" {
+			return
+		}
+		if err := storeLine(num, text); err != nil {
+			fmt.Println(err.Error())
+			continue
+		}
+		num += step
+	}
+	fmt.Printf("Line number %d isn't in range 0-%d\n", num, MaxLines)
+}
+
+// saveCommand ...
+// SAVE "file"
+func saveCommand(args []string) {
+	name, err := fileArg(args)
+	if err != nil {
+		fmt.Println(err.Error())
+		return
+	}
+
+	file, err := os.Create(name)
+	if err != nil {
+		fmt.Println(err.Error())
+		return
+	}
+	err = listLines(file, 0, MaxLines-1)
+	if cerr := file.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		fmt.Println(err.Error())
+	}
+}
+
+// loadCommand ...
+// LOAD "file", or MERGE "file" if merge is set, which keeps the lines already
+// in the program unless the file replaces them.
+func loadCommand(args []string, merge bool) {
+	name, err := fileArg(args)
+	if err != nil {
+		fmt.Println(err.Error())
+		return
+	}
+
+	file, err := os.Open(name)
+	if err != nil {
+		fmt.Println(err.Error())
+		return
+	}
+	defer file.Close()
+
+	if !merge {
+		clearProgram()
+		clearVars()
+	}
+	n, errs := loadProgram(file)
+	for _, err := range errs {
+		fmt.Println(err.Error())
+	}
+	fmt.Printf("Loaded %d lines\n", n)
+}
+
+// deleteCommand ...
+// DELETE N, DELETE N-M, DELETE -M or DELETE N-
+func deleteCommand(args []string) {
+	text := strings.Join(args, " ")
+	if strings.TrimSpace(text) == "" {
+		fmt.Println("Usage: DELETE N, DELETE N-M, DELETE -M or DELETE N-")
+		return
+	}
+	from, to, err := parseRange(text)
+	if err != nil {
+		fmt.Println(err.Error())
+		return
+	}
+
+	n := 0
+	for i := from; i <= to; i++ {
+		if lines[i] != nil && lines[i].Used {
+			n++
+		}
+		lines[i] = nil
+	}
+	clearBreakpoints(from, to)
+	fmt.Printf("Deleted %d lines\n", n)
+}
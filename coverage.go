@@ -0,0 +1,259 @@
+package main
+
+import (
+	"fmt"
+	"html/template"
+	"io"
+	"os"
+)
+
+// covering is set by --cover, to record which lines run and which way their
+// IFs go
+var covering bool
+
+// lineCoverage ...
+// How many times a line ran, and for an IF, how many times it was false and
+// how many times it was true
+type lineCoverage struct {
+	count int
+	taken [2]int
+}
+
+var coverage = make(map[int]*lineCoverage)
+
+// resetCoverage ...
+// Forgets what has run, before running another program.
+func resetCoverage() {
+	coverage = make(map[int]*lineCoverage)
+}
+
+// coverLine ...
+// Called before line index runs. CASE lines are only counted when their
+// SELECT picks them, not when the CASE before them ends.
+func coverLine(index int) {
+	if !covering {
+		return
+	}
+	switch lines[index].Tokens[0].Type {
+	case TokenCase, TokenCaseElse:
+		return
+	}
+	lineCovered(index).count++
+}
+
+// coverJump ...
+// Called when a SELECT jumps to the CASE it picks, or the END SELECT if it
+// picks none, or the end of a CASE jumps to its END SELECT.
+func coverJump(index int) {
+	if covering {
+		lineCovered(index).count++
+	}
+}
+
+// coverBranch ...
+// Called when the IF on the line being run is found to be pred.
+func coverBranch(pred bool) {
+	if !covering || currentLine < 0 {
+		return
+	}
+	if pred {
+		lineCovered(currentLine).taken[1]++
+	} else {
+		lineCovered(currentLine).taken[0]++
+	}
+}
+
+func lineCovered(index int) *lineCoverage {
+	c, ok := coverage[index]
+	if !ok {
+		c = &lineCoverage{}
+		coverage[index] = c
+	}
+	return c
+}
+
+// coverable ...
+// Returns the lines which count towards coverage: everything but the headers
+// of SUBs and FUNCTIONs, which are never run as such, and TEST blocks.
+func coverable(lines []*Line) []int {
+	indexes := []int{}
+	for i := 0; i < len(lines); i++ {
+		if lines[i] == nil || !lines[i].Used {
+			continue
+		}
+		switch lines[i].Tokens[0].Type {
+		case TokenSubroutine, TokenFunction:
+			continue
+		case TokenTest:
+			if end, err := skipTest(lines, i); err == nil {
+				i = end
+			}
+			continue
+		}
+		indexes = append(indexes, i)
+	}
+	return indexes
+}
+
+// coverageSummary ...
+// Returns how many of the lines which count towards coverage ran, and how
+// many of the ways their IFs could go were taken.
+func coverageSummary(lines []*Line) (run, total, taken, branches int) {
+	for _, index := range coverable(lines) {
+		total++
+		c, ok := coverage[index]
+		if ok && c.count > 0 {
+			run++
+		}
+		if lines[index].Tokens[0].Type != TokenIf {
+			continue
+		}
+		branches += 2
+		if !ok {
+			continue
+		}
+		for _, n := range c.taken {
+			if n > 0 {
+				taken++
+			}
+		}
+	}
+	return
+}
+
+func percent(n, total int) float64 {
+	if total == 0 {
+		return 100
+	}
+	return 100 * float64(n) / float64(total)
+}
+
+// coverageString ...
+// Returns a line summing up the coverage of the loaded program.
+func coverageString() string {
+	run, total, taken, branches := coverageSummary(lines)
+	return fmt.Sprintf("%d of %d lines run (%.1f%%), %d of %d IF branches taken (%.1f%%)",
+		run, total, percent(run, total), taken, branches, percent(taken, branches))
+}
+
+// missed ...
+// Returns what didn't happen on line index, or "" if everything did.
+func missed(index int) string {
+	c, ok := coverage[index]
+	if !ok || c.count == 0 {
+		return "never run"
+	}
+	if lines[index].Tokens[0].Type != TokenIf {
+		return ""
+	}
+	switch {
+	case c.taken[0] == 0 && c.taken[1] == 0:
+		return "IF never finished"
+	case c.taken[0] == 0:
+		return "IF never false"
+	case c.taken[1] == 0:
+		return "IF never true"
+	}
+	return ""
+}
+
+// writeCoverageReport ...
+// Writes the coverage summary, then each line which didn't run, or has an IF
+// which only ever went one way.
+func writeCoverageReport(w io.Writer) {
+	fmt.Fprintln(w, coverageString())
+	for _, index := range coverable(lines) {
+		if m := missed(index); m != "" {
+			fmt.Fprintf(w, "%d %s: %s\n", index, m, lines[index].Content)
+		}
+	}
+}
+
+var coverageTemplate = template.Must(template.New("coverage").Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>{{.Title}}</title>
+<style>
+body { font-family: monospace; }
+table { border-collapse: collapse; }
+td { padding: 0 0.5em; white-space: pre; }
+td.count { text-align: right; color: #888; }
+tr.run { background: #dfd; }
+tr.missed { background: #fdd; }
+tr.partial { background: #ffd; }
+</style>
+</head>
+<body>
+<h1>{{.Title}}</h1>
+<p>{{.Summary}}</p>
+<table>
+{{range .Lines}}<tr class="{{.Class}}" title="{{.Note}}"><td class="count">{{.Count}}</td><td>{{.Number}}</td><td>{{.Content}}</td></tr>
+{{end}}</table>
+</body>
+</html>
+`))
+
+// coverageRow ...
+// A line of the HTML listing
+type coverageRow struct {
+	Class, Note, Count, Content string
+	Number                      int
+}
+
+// writeCoverageHTML ...
+// Writes the loaded program as HTML, with the lines which ran in green, the
+// ones which didn't in red, and IFs which only went one way in yellow. Each
+// line shows how many times it ran. title is the name of the program.
+func writeCoverageHTML(w io.Writer, title string) error {
+	counted := make(map[int]bool)
+	for _, index := range coverable(lines) {
+		counted[index] = true
+	}
+	rows := []coverageRow{}
+	for index, line := range lines {
+		if line == nil || !line.Used {
+			continue
+		}
+		row := coverageRow{Number: index, Content: line.Content}
+		if counted[index] {
+			row.Note = missed(index)
+			switch {
+			case row.Note == "never run":
+				row.Class = "missed"
+			case row.Note != "":
+				row.Class = "partial"
+			default:
+				row.Class = "run"
+			}
+			if c, ok := coverage[index]; ok {
+				row.Count = fmt.Sprint(c.count)
+				if line.Tokens[0].Type == TokenIf {
+					row.Note = fmt.Sprintf("true %d, false %d times", c.taken[1], c.taken[0])
+				}
+			} else {
+				row.Count = "0"
+			}
+		}
+		rows = append(rows, row)
+	}
+
+	return coverageTemplate.Execute(w, struct {
+		Title, Summary string
+		Lines          []coverageRow
+	}{title, coverageString(), rows})
+}
+
+// saveCoverageHTML ...
+// Writes the HTML coverage listing for program to the file path.
+func saveCoverageHTML(path, program string) error {
+	file, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	if err := writeCoverageHTML(file, program); err != nil {
+		file.Close()
+		return err
+	}
+	return file.Close()
+}
@@ -0,0 +1,637 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// DefaultDAPPort ...
+// Port that DEBUG listens on if none is given
+const DefaultDAPPort int = 4711
+
+// dapRequest ...
+// A request from a client of the Debug Adapter Protocol
+type dapRequest struct {
+	Seq       int             `json:"seq"`
+	Type      string          `json:"type"`
+	Command   string          `json:"command"`
+	Arguments json.RawMessage `json:"arguments"`
+}
+
+// dapServer ...
+// A session of the Debug Adapter Protocol. If the program was launched from a
+// file, path is that file and lines are numbered as they are in it; otherwise
+// the client attached to the REPL, and is shown the program as LIST would.
+type dapServer struct {
+	r          *bufio.Reader
+	w          io.Writer
+	mu         sync.Mutex
+	seq        int
+	path       string
+	launched   bool
+	attached   bool
+	configured bool
+	started    bool
+	entry      bool
+	finished   bool
+}
+
+// dapOutput ...
+// Sends what the program prints to the client as output events.
+type dapOutput struct {
+	d *dapServer
+}
+
+func (o dapOutput) Write(p []byte) (int, error) {
+	o.d.event("output", map[string]interface{}{"category": "stdout", "output": string(p)})
+	return len(p), nil
+}
+
+func newDAPServer(r io.Reader, w io.Writer) *dapServer {
+	return &dapServer{r: bufio.NewReader(r), w: w}
+}
+
+// read ...
+// Reads the next request.
+func (d *dapServer) read() (*dapRequest, error) {
+	body, err := readMessage(d.r)
+	if err != nil {
+		return nil, err
+	}
+	req := &dapRequest{}
+	if err := json.Unmarshal(body, req); err != nil {
+		return nil, err
+	}
+	return req, nil
+}
+
+// send ...
+// Sends a message to the client. The program sends output events while it
+// runs, so this is safe to call from any goroutine.
+func (d *dapServer) send(msg map[string]interface{}) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.seq++
+	msg["seq"] = d.seq
+	body, err := json.Marshal(msg)
+	if err != nil {
+		return
+	}
+	writeMessage(d.w, body)
+}
+
+func (d *dapServer) respond(req *dapRequest, body interface{}) {
+	msg := map[string]interface{}{"type": "response", "request_seq": req.Seq, "command": req.Command, "success": true}
+	if body != nil {
+		msg["body"] = body
+	}
+	d.send(msg)
+}
+
+func (d *dapServer) fail(req *dapRequest, message string) {
+	d.send(map[string]interface{}{"type": "response", "request_seq": req.Seq, "command": req.Command,
+		"success": false, "message": message})
+}
+
+func (d *dapServer) event(name string, body interface{}) {
+	msg := map[string]interface{}{"type": "event", "event": name}
+	if body != nil {
+		msg["body"] = body
+	}
+	d.send(msg)
+}
+
+// serve ...
+// Handles requests until the client disconnects, and tells it when the
+// program stops.
+func (d *dapServer) serve() error {
+	requests := make(chan *dapRequest)
+	failed := make(chan error, 1)
+	quit := make(chan bool)
+	defer close(quit)
+	go func() {
+		for {
+			req, err := d.read()
+			if err != nil {
+				failed <- err
+				return
+			}
+			select {
+			case requests <- req:
+			case <-quit:
+				return
+			}
+		}
+	}()
+
+	for !d.finished {
+		select {
+		case req := <-requests:
+			d.handle(req)
+		case s := <-runningStops():
+			d.stopped(s)
+		case err := <-failed:
+			d.disconnect()
+			if err == io.EOF {
+				return nil
+			}
+			return err
+		}
+	}
+	return nil
+}
+
+func (d *dapServer) handle(req *dapRequest) {
+	switch req.Command {
+	case "initialize":
+		d.respond(req, map[string]interface{}{
+			"supportsConfigurationDoneRequest": true,
+			"supportsEvaluateForHovers":        true,
+			"supportsTerminateRequest":         true,
+		})
+		d.event("initialized", nil)
+	case "launch":
+		d.launch(req)
+	case "attach":
+		d.attached = true
+		d.respond(req, nil)
+		d.start()
+	case "setBreakpoints":
+		d.setBreakpoints(req)
+	case "setExceptionBreakpoints", "setFunctionBreakpoints":
+		d.respond(req, map[string]interface{}{"breakpoints": []interface{}{}})
+	case "configurationDone":
+		d.configured = true
+		d.respond(req, nil)
+		d.start()
+	case "threads":
+		d.respond(req, map[string]interface{}{
+			"threads": []interface{}{map[string]interface{}{"id": 1, "name": "main"}},
+		})
+	case "stackTrace":
+		d.stackTrace(req)
+	case "scopes":
+		d.scopes(req)
+	case "variables":
+		d.variables(req)
+	case "evaluate":
+		d.evaluate(req)
+	case "source":
+		var listing strings.Builder
+		listLines(&listing, 0, MaxLines-1)
+		d.respond(req, map[string]interface{}{"content": listing.String()})
+	case "continue", "next", "stepIn", "stepOut":
+		if current == nil || current.running {
+			d.fail(req, "The program isn't paused")
+			return
+		}
+		modes := map[string]stepMode{"continue": stepNone, "next": stepOver, "stepIn": stepInto, "stepOut": stepOut}
+		d.respond(req, map[string]interface{}{"allThreadsContinued": true})
+		resumeExecution(modes[req.Command])
+	case "pause":
+		atomic.StoreInt32(&interrupted, 1)
+		d.respond(req, nil)
+	case "terminate":
+		d.halt()
+		abortExecution()
+		d.respond(req, nil)
+		d.event("terminated", nil)
+	case "disconnect":
+		d.disconnect()
+		d.respond(req, nil)
+		d.finished = true
+	default:
+		d.fail(req, fmt.Sprintf("Unsupported request %s", req.Command))
+	}
+}
+
+// launch ...
+// Loads the program to debug from a file. It starts once the client has set
+// its breakpoints.
+func (d *dapServer) launch(req *dapRequest) {
+	args := struct {
+		Program     string `json:"program"`
+		StopOnEntry bool   `json:"stopOnEntry"`
+	}{}
+	if err := json.Unmarshal(req.Arguments, &args); err != nil || args.Program == "" {
+		d.fail(req, "launch needs a program to run")
+		return
+	}
+	file, err := os.Open(args.Program)
+	if err != nil {
+		d.fail(req, err.Error())
+		return
+	}
+	defer file.Close()
+
+	abortExecution()
+	clearProgram()
+	clearVars()
+	if _, errs := loadProgram(file); len(errs) > 0 {
+		messages := make([]string, len(errs))
+		for i, err := range errs {
+			messages[i] = err.Error()
+		}
+		d.fail(req, strings.Join(messages, "\n"))
+		return
+	}
+
+	d.path, _ = filepath.Abs(args.Program)
+	d.entry = args.StopOnEntry
+	d.launched = true
+	d.respond(req, nil)
+	d.start()
+}
+
+// start ...
+// Runs the program once it's been launched and the client is ready. A client
+// attaching to a program which is already paused is told where it is instead.
+func (d *dapServer) start() {
+	if d.started || !d.configured || !(d.launched || d.attached) {
+		return
+	}
+	d.started = true
+	if current != nil {
+		d.event("stopped", map[string]interface{}{"reason": "pause", "threadId": 1, "allThreadsStopped": true})
+		return
+	}
+	step := stepNone
+	if d.entry {
+		step = stepInto
+	}
+	launchExecution(step)
+}
+
+// stopped ...
+// Tells the client that the program paused or ended.
+func (d *dapServer) stopped(s stop) {
+	stopped(s)
+	if s.done {
+		code := 0
+		if s.err != nil && s.err != errEnd && s.err != errAbort {
+			d.event("output", map[string]interface{}{"category": "stderr", "output": s.err.Error() + "\n"})
+			code = 1
+		}
+		d.event("exited", map[string]interface{}{"exitCode": code})
+		d.event("terminated", nil)
+		return
+	}
+
+	reason := map[stopReason]string{
+		reasonInterrupt:  "pause",
+		reasonStop:       "pause",
+		reasonStep:       "step",
+		reasonBreakpoint: "breakpoint",
+		reasonWatch:      "data breakpoint",
+		reasonRestore:    "pause",
+	}[s.reason]
+	if d.entry {
+		reason = "entry"
+		d.entry = false
+	}
+	d.event("stopped", map[string]interface{}{"reason": reason, "description": s.message,
+		"threadId": 1, "allThreadsStopped": true})
+}
+
+// halt ...
+// Pauses the program if it's running, and waits until it does.
+func (d *dapServer) halt() {
+	if stops := runningStops(); stops != nil {
+		atomic.StoreInt32(&interrupted, 1)
+		stopped(<-stops)
+	}
+}
+
+// disconnect ...
+// Ends a launched program; one attached to is left paused for the REPL.
+func (d *dapServer) disconnect() {
+	d.halt()
+	if !d.attached {
+		abortExecution()
+	}
+}
+
+// paused ...
+// Whether the program can be looked at
+func (d *dapServer) paused() bool {
+	return current != nil && !current.running
+}
+
+func (d *dapServer) source() map[string]interface{} {
+	if d.path != "" {
+		return map[string]interface{}{"name": filepath.Base(d.path), "path": d.path}
+	}
+	return map[string]interface{}{"name": "program", "sourceReference": 1}
+}
+
+// dapLine ...
+// Returns the number the client knows line index by.
+func (d *dapServer) dapLine(index int) int {
+	if d.path != "" {
+		return lines[index].Source
+	}
+	n := 0
+	for i := 0; i <= index && i < len(lines); i++ {
+		if lines[i] != nil && lines[i].Used {
+			n++
+		}
+	}
+	return n
+}
+
+// lineIndex ...
+// Returns the index of the first line that the client knows by n or a later
+// number, or -1 if there isn't one.
+func (d *dapServer) lineIndex(n int) int {
+	best, bestLine := -1, 0
+	count := 0
+	for i, line := range lines {
+		if line == nil || !line.Used {
+			continue
+		}
+		count++
+		at := count
+		if d.path != "" {
+			at = line.Source
+		}
+		if at >= n && (best == -1 || at < bestLine) {
+			best, bestLine = i, at
+		}
+	}
+	return best
+}
+
+func (d *dapServer) setBreakpoints(req *dapRequest) {
+	args := struct {
+		Breakpoints []struct {
+			Line int `json:"line"`
+		} `json:"breakpoints"`
+	}{}
+	if err := json.Unmarshal(req.Arguments, &args); err != nil {
+		d.fail(req, err.Error())
+		return
+	}
+
+	indexes := []int{}
+	result := []interface{}{}
+	for _, bp := range args.Breakpoints {
+		index := d.lineIndex(bp.Line)
+		if index == -1 {
+			result = append(result, map[string]interface{}{"verified": false, "line": bp.Line,
+				"message": "There's no code on or after this line"})
+			continue
+		}
+		indexes = append(indexes, index)
+		result = append(result, map[string]interface{}{"verified": true, "line": d.dapLine(index)})
+	}
+	setBreakpoints(indexes)
+	d.respond(req, map[string]interface{}{"breakpoints": result})
+}
+
+// stackTrace ...
+// Frame 0 is the line the program is paused at, and each frame after it is
+// the line that made the call the frame before it is inside.
+func (d *dapServer) stackTrace(req *dapRequest) {
+	frames := []interface{}{}
+	if !d.paused() {
+		d.respond(req, map[string]interface{}{"stackFrames": frames, "totalFrames": 0})
+		return
+	}
+
+	index := current.index
+	for j := 0; j <= len(callStack); j++ {
+		k := len(callStack) - 1 - j
+		name := "main"
+		if k >= 0 {
+			name = callStack[k].name
+		}
+		frames = append(frames, map[string]interface{}{"id": j, "name": name, "line": d.dapLine(index),
+			"column": 1, "source": d.source()})
+		if k < 0 || callStack[k].from < 0 {
+			break
+		}
+		index = callStack[k].from
+	}
+	d.respond(req, map[string]interface{}{"stackFrames": frames, "totalFrames": len(frames)})
+}
+
+// frameScope ...
+// Returns the variables local to the call that frame id of the stack trace is
+// inside, if it has any.
+func frameScope(id int) *scope {
+	k := len(callStack) - 1 - id
+	if k < 0 || k >= len(callStack) {
+		return nil
+	}
+	return callStack[k].scope
+}
+
+// scopes ...
+// Globals are variablesReference 1, and the locals of frame id are id + 2.
+func (d *dapServer) scopes(req *dapRequest) {
+	args := struct {
+		FrameID int `json:"frameId"`
+	}{}
+	json.Unmarshal(req.Arguments, &args)
+
+	result := []interface{}{}
+	if d.paused() && frameScope(args.FrameID) != nil {
+		result = append(result, map[string]interface{}{"name": "Locals", "variablesReference": args.FrameID + 2,
+			"expensive": false})
+	}
+	result = append(result, map[string]interface{}{"name": "Globals", "variablesReference": 1, "expensive": false})
+	d.respond(req, map[string]interface{}{"scopes": result})
+}
+
+func (d *dapServer) variables(req *dapRequest) {
+	args := struct {
+		VariablesReference int `json:"variablesReference"`
+	}{}
+	json.Unmarshal(req.Arguments, &args)
+
+	// The program's goroutine changes the variables while it runs
+	vars := map[string]value{}
+	if !d.paused() {
+		d.respond(req, map[string]interface{}{"variables": []interface{}{}})
+		return
+	}
+	if args.VariablesReference == 1 {
+		for name, i := range intVars {
+			vars[name] = value{i: i}
+		}
+		for name, s := range stringVars {
+			vars[name] = value{isStr: true, s: s}
+		}
+	} else if s := frameScope(args.VariablesReference - 2); s != nil {
+		for name, i := range s.ints {
+			vars[name] = value{i: i}
+		}
+		for name, str := range s.strs {
+			vars[name] = value{isStr: true, s: str}
+		}
+		for name, r := range s.refs {
+			vars[name] = refValue(r)
+		}
+	}
+
+	names := []string{}
+	for name := range vars {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	result := []interface{}{}
+	for _, name := range names {
+		kind := "integer"
+		if vars[name].isStr {
+			kind = "string"
+		}
+		result = append(result, map[string]interface{}{"name": name, "value": vars[name].literal(), "type": kind,
+			"variablesReference": 0})
+	}
+	d.respond(req, map[string]interface{}{"variables": result})
+}
+
+// refValue ...
+// Returns the value of the variable a BYREF parameter refers to.
+func refValue(r ref) value {
+	ints, strs := intVars, stringVars
+	if r.s != nil {
+		ints, strs = r.s.ints, r.s.strs
+	}
+	if _, stringp := validIdentifierStrP(r.name); stringp {
+		return value{isStr: true, s: strs[r.name]}
+	}
+	return value{i: ints[r.name]}
+}
+
+// evaluate ...
+// Evaluates an expression with the variables the paused program can see, as
+// PRINT would at the REPL.
+func (d *dapServer) evaluate(req *dapRequest) {
+	args := struct {
+		Expression string `json:"expression"`
+	}{}
+	json.Unmarshal(req.Arguments, &args)
+	if current != nil && current.running {
+		d.fail(req, "The program is running")
+		return
+	}
+
+	tokens, err := lexExpr(strings.Split(strings.TrimSpace(args.Expression), " "))
+	if err != nil {
+		d.fail(req, err.Error())
+		return
+	}
+	savedCalls, savedScopes, savedLine := callStack, scopes, currentLine
+	currentLine = -1
+	v, err := evalExpr(tokens)
+	callStack, scopes, currentLine = savedCalls, savedScopes, savedLine
+	if err != nil {
+		d.fail(req, err.Error())
+		return
+	}
+	d.respond(req, map[string]interface{}{"result": v.literal(), "variablesReference": 0})
+}
+
+// acceptDAP ...
+// Waits for a debugger to connect to port on localhost, or for Ctrl-C.
+func acceptDAP(port int) (net.Conn, error) {
+	l, err := net.ListenTCP("tcp", &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: port})
+	if err != nil {
+		return nil, err
+	}
+	defer l.Close()
+	fmt.Printf("Waiting for a debugger on %s\n", l.Addr().String())
+
+	atomic.StoreInt32(&interrupted, 0)
+	for {
+		l.SetDeadline(time.Now().Add(200 * time.Millisecond))
+		conn, err := l.AcceptTCP()
+		if err == nil {
+			return conn, nil
+		}
+		if ne, ok := err.(net.Error); !ok || !ne.Timeout() {
+			return nil, err
+		}
+		if atomic.SwapInt32(&interrupted, 0) == 1 {
+			return nil, errInterrupted
+		}
+	}
+}
+
+// dapCommand ...
+// ez dap [-port N] serves the Debug Adapter Protocol on standard input and
+// output, or to one client on a TCP port.
+func dapCommand(args []string) {
+	flags := flag.NewFlagSet("dap", flag.ExitOnError)
+	port := flags.Int("port", 0, "listen on this port on localhost, instead of using standard input and output")
+	flags.Parse(args)
+
+	var err error
+	if *port == 0 {
+		d := newDAPServer(os.Stdin, os.Stdout)
+		output = dapOutput{d}
+		// Standard input belongs to the client, so INPUT gets nothing
+		stdin = bufio.NewReader(strings.NewReader(""))
+		err = d.serve()
+	} else {
+		var conn net.Conn
+		conn, err = acceptDAP(*port)
+		if err == nil {
+			d := newDAPServer(conn, conn)
+			output = io.MultiWriter(os.Stdout, dapOutput{d})
+			err = d.serve()
+			conn.Close()
+		}
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err.Error())
+		os.Exit(1)
+	}
+}
+
+// debugCommand ...
+// DEBUG [port] waits for a debugger to connect, and lets it control the
+// program until it disconnects.
+func debugCommand(args []string) {
+	port := DefaultDAPPort
+	if text := strings.TrimSpace(strings.Join(args, " ")); text != "" {
+		var err error
+		if port, err = strconv.Atoi(text); err != nil {
+			fmt.Printf("Bad port number \"%s\": %s\n", text, err.Error())
+			return
+		}
+	}
+
+	conn, err := acceptDAP(port)
+	if err != nil {
+		fmt.Println(err.Error())
+		return
+	}
+	defer conn.Close()
+
+	d := newDAPServer(conn, conn)
+	saved := output
+	output = io.MultiWriter(os.Stdout, dapOutput{d})
+	err = d.serve()
+	output = saved
+	if err != nil {
+		fmt.Println(err.Error())
+	}
+	fmt.Println("Debugger disconnected")
+	if current != nil {
+		fmt.Printf("BREAK IN %d\n", current.index)
+	}
+}
@@ -0,0 +1,237 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+// dapClient ...
+// The client end of a DAP session over pipes, for tests
+type dapClient struct {
+	t        *testing.T
+	w        io.Writer
+	seq      int
+	messages chan map[string]interface{}
+	events   []map[string]interface{}
+}
+
+func newDAPClient(t *testing.T, r io.Reader, w io.Writer) *dapClient {
+	c := &dapClient{t: t, w: w, messages: make(chan map[string]interface{}, 100)}
+	go func() {
+		br := bufio.NewReader(r)
+		for {
+			body, err := readMessage(br)
+			if err != nil {
+				close(c.messages)
+				return
+			}
+			msg := map[string]interface{}{}
+			if err := json.Unmarshal(body, &msg); err != nil {
+				close(c.messages)
+				return
+			}
+			c.messages <- msg
+		}
+	}()
+	return c
+}
+
+// next ...
+// Returns the next message from the server, failing the test if there isn't
+// one soon.
+func (c *dapClient) next() map[string]interface{} {
+	c.t.Helper()
+	select {
+	case msg, ok := <-c.messages:
+		if !ok {
+			c.t.Fatal("server closed the connection")
+		}
+		return msg
+	case <-time.After(5 * time.Second):
+		c.t.Fatal("timed out waiting for the server")
+	}
+	return nil
+}
+
+// request ...
+// Sends a request and returns the body of its response, keeping the events
+// which come first.
+func (c *dapClient) request(command string, args interface{}) map[string]interface{} {
+	c.t.Helper()
+	c.seq++
+	body, _ := json.Marshal(map[string]interface{}{"seq": c.seq, "type": "request", "command": command,
+		"arguments": args})
+	if err := writeMessage(c.w, body); err != nil {
+		c.t.Fatal(err)
+	}
+	for {
+		msg := c.next()
+		if msg["type"] == "event" {
+			c.events = append(c.events, msg)
+			continue
+		}
+		if msg["request_seq"] != float64(c.seq) || msg["success"] != true {
+			c.t.Fatalf("%s failed: %v", command, msg)
+		}
+		resp, _ := msg["body"].(map[string]interface{})
+		return resp
+	}
+}
+
+// event ...
+// Waits for the event called name and returns its body.
+func (c *dapClient) event(name string) map[string]interface{} {
+	c.t.Helper()
+	for i, msg := range c.events {
+		if msg["event"] == name {
+			c.events = append(c.events[:i:i], c.events[i+1:]...)
+			body, _ := msg["body"].(map[string]interface{})
+			return body
+		}
+	}
+	for {
+		msg := c.next()
+		if msg["event"] == name {
+			body, _ := msg["body"].(map[string]interface{})
+			return body
+		}
+		c.events = append(c.events, msg)
+	}
+}
+
+// startDAP ...
+// Starts a DAP server talking to a client over pipes, as ez dap and DEBUG
+// do. The server's result is sent on served once the client disconnects.
+func startDAP(t *testing.T) (c *dapClient, served chan error) {
+	clientR, serverW := io.Pipe()
+	serverR, clientW := io.Pipe()
+	d := newDAPServer(serverR, serverW)
+	savedOutput, savedStdin := output, stdin
+	output = dapOutput{d}
+	stdin = bufio.NewReader(strings.NewReader(""))
+	t.Cleanup(func() {
+		output, stdin = savedOutput, savedStdin
+		setBreakpoints(nil)
+		clientW.Close()
+		serverW.Close()
+	})
+	served = make(chan error, 1)
+	go func() { served <- d.serve() }()
+	return newDAPClient(t, clientR, clientW), served
+}
+
+// variableList ...
+// Returns the variables in a variables response as name=value.
+func variableList(body map[string]interface{}) []string {
+	vars, _ := body["variables"].([]interface{})
+	ret := []string{}
+	for _, v := range vars {
+		variable := v.(map[string]interface{})
+		ret = append(ret, variable["name"].(string)+"="+variable["value"].(string))
+	}
+	return ret
+}
+
+func TestDAPSession(t *testing.T) {
+	c, served := startDAP(t)
+	c.request("initialize", map[string]interface{}{"adapterID": "ez"})
+	c.event("initialized")
+	c.request("launch", map[string]interface{}{"program": "testdata/procedures.bas"})
+	bps := c.request("setBreakpoints", map[string]interface{}{"breakpoints": []interface{}{
+		map[string]interface{}{"line": 7}}})
+	want := []interface{}{map[string]interface{}{"verified": true, "line": float64(7)}}
+	if !reflect.DeepEqual(bps["breakpoints"], want) {
+		t.Errorf("setBreakpoints got %v, want %v", bps["breakpoints"], want)
+	}
+	c.request("configurationDone", nil)
+	if reason := c.event("stopped")["reason"]; reason != "breakpoint" {
+		t.Errorf("stopped for %v, want breakpoint", reason)
+	}
+
+	frames, _ := c.request("stackTrace", map[string]interface{}{"threadId": 1})["stackFrames"].([]interface{})
+	got := []string{}
+	for _, f := range frames {
+		frame := f.(map[string]interface{})
+		got = append(got, fmt.Sprintf("%s:%v", frame["name"], frame["line"]))
+	}
+	if want := []string{"swap:7", "main:2"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("stackTrace got %v, want %v", got, want)
+	}
+
+	got = variableList(c.request("variables", map[string]interface{}{"variablesReference": 1}))
+	if want := []string{"a=3", "b=4"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("variables got %v, want %v", got, want)
+	}
+
+	c.request("continue", map[string]interface{}{"threadId": 1})
+	if code := c.event("exited")["exitCode"]; code != float64(0) {
+		t.Errorf("exited with %v, want 0", code)
+	}
+	printed := ""
+	for _, msg := range c.events {
+		if msg["event"] == "output" {
+			printed += msg["body"].(map[string]interface{})["output"].(string)
+		}
+	}
+	if printed != "4 3 24\n" {
+		t.Errorf("program printed %q, want \"4 3 24\\n\"", printed)
+	}
+
+	// Once the program has ended there are no variables to show
+	if vars := variableList(c.request("variables", map[string]interface{}{"variablesReference": 1})); len(vars) != 0 {
+		t.Errorf("variables after exiting got %v, want none", vars)
+	}
+
+	c.request("disconnect", nil)
+	if err := <-served; err != nil {
+		t.Error(err)
+	}
+}
+
+func TestDAPAttach(t *testing.T) {
+	// DEBUG attaches to the program typed into the REPL, whose lines the
+	// client knows by their position in LIST
+	abortExecution()
+	clearProgram()
+	clearVars()
+	defer abortExecution()
+	for num, text := range map[int]string{10: "LET a = 1", 20: `LET b$ = "x"`, 30: "PRINT a b$"} {
+		if err := storeLine(num, text); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	c, served := startDAP(t)
+	c.request("initialize", map[string]interface{}{"adapterID": "ez"})
+	c.event("initialized")
+	c.request("attach", nil)
+	bps := c.request("setBreakpoints", map[string]interface{}{"breakpoints": []interface{}{
+		map[string]interface{}{"line": 3}}})
+	want := []interface{}{map[string]interface{}{"verified": true, "line": float64(3)}}
+	if !reflect.DeepEqual(bps["breakpoints"], want) {
+		t.Errorf("setBreakpoints got %v, want %v", bps["breakpoints"], want)
+	}
+	c.request("configurationDone", nil)
+	if reason := c.event("stopped")["reason"]; reason != "breakpoint" {
+		t.Errorf("stopped for %v, want breakpoint", reason)
+	}
+	got := variableList(c.request("variables", map[string]interface{}{"variablesReference": 1}))
+	if want := []string{"a=1", `b$="x"`}; !reflect.DeepEqual(got, want) {
+		t.Errorf("variables got %v, want %v", got, want)
+	}
+
+	// Disconnecting leaves the program paused for the REPL
+	c.request("disconnect", nil)
+	if err := <-served; err != nil {
+		t.Error(err)
+	}
+	if current == nil || current.running || current.index != 30 {
+		t.Errorf("expected the program to be left paused at line 30, got %+v", current)
+	}
+}
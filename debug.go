@@ -0,0 +1,203 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// watch ...
+// A variable watched with WATCH, and the value it had when last checked
+type watch struct {
+	t    Token
+	last value
+}
+
+// breakpoints can be changed by a debugger while the program runs, so they
+// are guarded by breakMu
+var breakpoints = make(map[int]bool)
+var breakMu sync.Mutex
+var watches []*watch
+
+func hasBreakpoint(index int) bool {
+	breakMu.Lock()
+	defer breakMu.Unlock()
+	return breakpoints[index]
+}
+
+// setBreakpoints ...
+// Replaces all of the breakpoints with the lines in indexes.
+func setBreakpoints(indexes []int) {
+	breakMu.Lock()
+	defer breakMu.Unlock()
+	breakpoints = make(map[int]bool)
+	for _, index := range indexes {
+		breakpoints[index] = true
+	}
+}
+
+// renumberBreakpoints ...
+// Moves the breakpoints from oldStart onwards to follow the lines RENUM
+// moved, using its mapping from old line numbers to new ones. Breakpoints on
+// lines past oldStart which don't exist are dropped.
+func renumberBreakpoints(mapping map[int]int, oldStart int) {
+	breakMu.Lock()
+	defer breakMu.Unlock()
+	moved := make(map[int]bool)
+	for index := range breakpoints {
+		if newindex, ok := mapping[index]; ok {
+			moved[newindex] = true
+		} else if index < oldStart {
+			moved[index] = true
+		}
+	}
+	breakpoints = moved
+}
+
+// clearBreakpoints ...
+// Removes the breakpoints on lines from to to, which have been deleted.
+func clearBreakpoints(from, to int) {
+	breakMu.Lock()
+	defer breakMu.Unlock()
+	for index := range breakpoints {
+		if from <= index && index <= to {
+			delete(breakpoints, index)
+		}
+	}
+}
+
+// lineListing ...
+// Returns line index as LIST would show it.
+func lineListing(index int) string {
+	if index < 0 || index >= len(lines) || lines[index] == nil {
+		return ""
+	}
+	return fmt.Sprintf("%d %s", index, lines[index].Content)
+}
+
+// updateWatches ...
+// Remembers the current values of the watched variables, so that changes made
+// while the program is paused don't stop it again.
+func updateWatches() {
+	for _, w := range watches {
+		if v, err := evalOperand(w.t); err == nil {
+			w.last = v
+		}
+	}
+}
+
+// breakCommand ...
+// BREAK [line[, line...]] sets breakpoints, or lists them and the watches.
+// UNBREAK [line[, line...]] clears them, or all of them.
+func breakCommand(args []string, set bool) {
+	breakMu.Lock()
+	defer breakMu.Unlock()
+	text := strings.TrimSpace(strings.Join(args, " "))
+	if text == "" {
+		if !set {
+			breakpoints = make(map[int]bool)
+			return
+		}
+		nums := []int{}
+		for num := range breakpoints {
+			nums = append(nums, num)
+		}
+		sort.Ints(nums)
+		for _, num := range nums {
+			fmt.Println("BREAK", num)
+		}
+		for _, w := range watches {
+			fmt.Println("WATCH", w.t.StringData)
+		}
+		return
+	}
+
+	if err := indexLabels(lines); err != nil {
+		fmt.Println(err.Error())
+		return
+	}
+	for _, arg := range splitCommas(text) {
+		num, err := strconv.Atoi(arg)
+		if err != nil {
+			var ok bool
+			if num, ok = labels[arg]; !ok {
+				fmt.Printf("Bad line number or label \"%s\"\n", arg)
+				continue
+			}
+		}
+		if !set {
+			delete(breakpoints, num)
+		} else if num < 0 || num >= len(lines) || lines[num] == nil || !lines[num].Used {
+			fmt.Printf("Line %d doesn't exist\n", num)
+		} else {
+			breakpoints[num] = true
+		}
+	}
+}
+
+// watchCommand ...
+// WATCH var[, var...] stops the program whenever one of the variables changes.
+// UNWATCH [var[, var...]] stops watching them, or all of them.
+func watchCommand(args []string, set bool) {
+	text := strings.TrimSpace(strings.Join(args, " "))
+	if text == "" {
+		if set {
+			fmt.Println("Usage: WATCH var[, var...]")
+		} else {
+			watches = nil
+		}
+		return
+	}
+
+	for _, name := range splitCommas(text) {
+		valid, stringp := validIdentifierStrP(name)
+		if !valid {
+			fmt.Printf("Invalid identifier %s\n", name)
+			continue
+		}
+		kept := []*watch{}
+		for _, w := range watches {
+			if w.t.StringData != name {
+				kept = append(kept, w)
+			}
+		}
+		watches = kept
+		if !set {
+			continue
+		}
+
+		t := Token{Type: TokenIdentInt, StringData: name}
+		if stringp {
+			t.Type = TokenIdentStr
+		}
+		w := &watch{t: t}
+		w.last, _ = evalOperand(t)
+		watches = append(watches, w)
+	}
+}
+
+// whereCommand ...
+// WHERE shows the line the program is paused at, and the calls it's inside.
+func whereCommand() {
+	if current == nil {
+		fmt.Println("No program is stopped")
+		return
+	}
+	fmt.Println(lineListing(current.index))
+	for i := len(callStack) - 1; i >= 0; i-- {
+		f := callStack[i]
+		name := f.name
+		if f.proc != nil && f.proc.function {
+			name = "FUNCTION " + name
+		} else if f.proc != nil {
+			name = "SUB " + name
+		}
+		if f.from < 0 {
+			fmt.Printf("  in %s, called from the prompt\n", name)
+		} else {
+			fmt.Printf("  in %s, called from line %d\n", name, f.from)
+		}
+	}
+}
@@ -0,0 +1,141 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+)
+
+func dotEscape(s string) string {
+	return strings.NewReplacer(`\`, `\\`, `"`, `\"`).Replace(s)
+}
+
+// writeDot ...
+// Writes the control flow graph of a program in Graphviz's DOT language, named
+// name. Unless byLine is set, lines which always run one after the other are
+// put together in one node, a basic block.
+func writeDot(w io.Writer, prog []*Line, name string, byLine bool) error {
+	g, err := controlFlow(prog)
+	if err != nil {
+		return err
+	}
+	edges, first := g.edges, g.entry
+	outs := make(map[int][]flowEdge)
+	ins := make(map[int]int)
+	for _, e := range edges {
+		outs[e.from] = append(outs[e.from], e)
+		ins[e.to]++
+	}
+
+	// leader maps each line to the first line of its block
+	leader := make(map[int]int)
+	blocks := [][]int{}
+	for i, line := range prog {
+		if line == nil || !line.Used {
+			continue
+		}
+		prev := -1
+		if len(blocks) > 0 {
+			block := blocks[len(blocks)-1]
+			prev = block[len(block)-1]
+		}
+		joined := !byLine && prev != -1 && i != first && ins[i] == 1 && len(outs[prev]) == 1 &&
+			outs[prev][0].to == i && outs[prev][0].label == ""
+		if joined {
+			blocks[len(blocks)-1] = append(blocks[len(blocks)-1], i)
+		} else {
+			blocks = append(blocks, []int{i})
+		}
+		leader[i] = blocks[len(blocks)-1][0]
+	}
+
+	var b strings.Builder
+	fmt.Fprintf(&b, "digraph \"%s\" {\n", dotEscape(name))
+	b.WriteString("\tnode [shape=box, fontname=\"monospace\"];\n")
+	if first != -1 {
+		b.WriteString("\tstart [shape=point];\n")
+		fmt.Fprintf(&b, "\tstart -> n%d;\n", first)
+	}
+	for _, block := range blocks {
+		var label strings.Builder
+		for _, i := range block {
+			fmt.Fprintf(&label, "%d %s\\l", i, dotEscape(prog[i].Content))
+		}
+		fmt.Fprintf(&b, "\tn%d [label=\"%s\"];\n", block[0], label.String())
+	}
+
+	unknown, missing := false, []int{}
+	for _, block := range blocks {
+		for _, e := range outs[block[len(block)-1]] {
+			to := "unknown"
+			if e.to == unknownLine {
+				unknown = true
+			} else if l, ok := leader[e.to]; ok {
+				to = fmt.Sprintf("n%d", l)
+			} else {
+				to = fmt.Sprintf("n%d", e.to)
+				missing = append(missing, e.to)
+			}
+			attrs := []string{}
+			if e.label != "" {
+				attrs = append(attrs, fmt.Sprintf("label=\"%s\"", dotEscape(e.label)))
+			}
+			if e.dashed() {
+				attrs = append(attrs, "style=dashed")
+			}
+			if len(attrs) > 0 {
+				fmt.Fprintf(&b, "\tn%d -> %s [%s];\n", block[0], to, strings.Join(attrs, ", "))
+			} else {
+				fmt.Fprintf(&b, "\tn%d -> %s;\n", block[0], to)
+			}
+		}
+	}
+	if unknown {
+		b.WriteString("\tunknown [label=\"?\", shape=ellipse, style=dashed];\n")
+	}
+	sort.Ints(missing)
+	for j, i := range missing {
+		if j > 0 && missing[j-1] == i {
+			continue
+		}
+		fmt.Fprintf(&b, "\tn%d [label=\"%d doesn't exist\", color=red];\n", i, i)
+	}
+	b.WriteString("}\n")
+
+	_, err = io.WriteString(w, b.String())
+	return err
+}
+
+// dotCommand ...
+// ez dot [-lines] file prints the control flow graph of a program in
+// Graphviz's DOT language, e.g. for dot -Tsvg.
+func dotCommand(args []string) {
+	flags := flag.NewFlagSet("dot", flag.ExitOnError)
+	byLine := flags.Bool("lines", false, "make each line a node, instead of each basic block")
+	flags.Parse(args)
+	if flags.NArg() != 1 {
+		fmt.Fprintln(os.Stderr, "Usage: ez dot [-lines] file")
+		os.Exit(2)
+	}
+
+	name := flags.Arg(0)
+	file, err := os.Open(name)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err.Error())
+		os.Exit(1)
+	}
+	prog, errs := parseProgram(file)
+	file.Close()
+	reportParseErrors(os.Stderr, name, errs)
+	if len(errs) > 0 {
+		os.Exit(1)
+	}
+
+	if err := writeDot(os.Stdout, prog, name, *byLine); err != nil {
+		fmt.Fprintln(os.Stderr, err.Error())
+		os.Exit(1)
+	}
+}
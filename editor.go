@@ -0,0 +1,397 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"strings"
+)
+
+// MaxHistory ...
+// Maximum number of lines kept in the history
+const MaxHistory int = 1000
+
+var errInterrupted = fmt.Errorf("Interrupted")
+
+// lineEditor ...
+// A small line editor for the REPL, with history, reverse search (Ctrl-R) and
+// tab completion. It only works on terminals which can be put into raw mode;
+// anywhere else it reads plain lines.
+type lineEditor struct {
+	history  []string
+	histPath string
+	complete func(word string) []string
+}
+
+// editState ...
+// The line being edited; pos is the index of the cursor in buf.
+type editState struct {
+	prompt  string
+	buf     []rune
+	pos     int
+	hist    int
+	pending []rune
+}
+
+func newLineEditor(histPath string, complete func(word string) []string) *lineEditor {
+	e := &lineEditor{histPath: histPath, complete: complete}
+	e.loadHistory()
+	return e
+}
+
+func (e *lineEditor) loadHistory() {
+	if e.histPath == "" {
+		return
+	}
+	data, err := ioutil.ReadFile(e.histPath)
+	if err != nil {
+		return
+	}
+	for _, line := range strings.Split(string(data), "\n") {
+		if line != "" {
+			e.history = append(e.history, line)
+		}
+	}
+	if len(e.history) > MaxHistory {
+		e.history = e.history[len(e.history)-MaxHistory:]
+		if err := ioutil.WriteFile(e.histPath, []byte(strings.Join(e.history, "\n")+"\n"), 0600); err != nil {
+			e.historyFailed(err)
+		}
+	}
+}
+
+// historyFailed ...
+// Reports that the history couldn't be saved, and stops trying, so that it's
+// only reported once. The terminal may be in raw mode, hence the \r.
+func (e *lineEditor) historyFailed(err error) {
+	fmt.Printf("Can't save the history: %s\r\n", err.Error())
+	e.histPath = ""
+}
+
+func (e *lineEditor) addHistory(line string) {
+	if strings.TrimSpace(line) == "" || (len(e.history) > 0 && e.history[len(e.history)-1] == line) {
+		return
+	}
+	e.history = append(e.history, line)
+	if len(e.history) > MaxHistory {
+		e.history = e.history[1:]
+	}
+
+	if e.histPath == "" {
+		return
+	}
+	file, err := os.OpenFile(e.histPath, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+	if err != nil {
+		e.historyFailed(err)
+		return
+	}
+	_, err = fmt.Fprintln(file, line)
+	if cerr := file.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		e.historyFailed(err)
+	}
+}
+
+// readLine ...
+// Reads a line, showing prompt, with initial already typed in. Returns
+// errInterrupted if Ctrl-C is pressed, or io.EOF for Ctrl-D on an empty line.
+func (e *lineEditor) readLine(prompt, initial string) (string, error) {
+	restore, err := makeRaw(os.Stdin)
+	if err != nil {
+		if initial != "" {
+			fmt.Println(initial)
+		}
+		fmt.Print(prompt)
+		return readInputLine()
+	}
+	defer restore()
+
+	st := &editState{prompt: prompt, buf: []rune(initial), hist: len(e.history)}
+	st.pos = len(st.buf)
+	e.refresh(st)
+
+	for {
+		r, _, err := stdin.ReadRune()
+		if err != nil {
+			fmt.Print("\r\n")
+			return "", err
+		}
+
+		switch r {
+		case '\r', '\n':
+			fmt.Print("\r\n")
+			line := string(st.buf)
+			e.addHistory(line)
+			return line, nil
+		case 3: // Ctrl-C
+			fmt.Print("^C\r\n")
+			return "", errInterrupted
+		case 4: // Ctrl-D
+			if len(st.buf) == 0 {
+				fmt.Print("\r\n")
+				return "", io.EOF
+			}
+			st.deleteChar()
+		case 1: // Ctrl-A
+			st.pos = 0
+		case 5: // Ctrl-E
+			st.pos = len(st.buf)
+		case 2: // Ctrl-B
+			st.left()
+		case 6: // Ctrl-F
+			st.right()
+		case 8, 127: // Backspace
+			if st.pos > 0 {
+				st.pos--
+				st.deleteChar()
+			}
+		case 11: // Ctrl-K
+			st.buf = st.buf[:st.pos]
+		case 21: // Ctrl-U
+			st.buf = st.buf[st.pos:]
+			st.pos = 0
+		case 23: // Ctrl-W
+			start := st.pos
+			for start > 0 && st.buf[start-1] == ' ' {
+				start--
+			}
+			for start > 0 && st.buf[start-1] != ' ' {
+				start--
+			}
+			st.buf = append(st.buf[:start], st.buf[st.pos:]...)
+			st.pos = start
+		case 12: // Ctrl-L
+			fmt.Print("\x1b[H\x1b[2J")
+		case 16: // Ctrl-P
+			e.historyMove(st, -1)
+		case 14: // Ctrl-N
+			e.historyMove(st, 1)
+		case 18: // Ctrl-R
+			if e.search(st) {
+				fmt.Print("\r\n")
+				line := string(st.buf)
+				e.addHistory(line)
+				return line, nil
+			}
+		case '\t':
+			e.completeWord(st)
+		case 27: // Escape sequences for the arrow keys etc.
+			e.escape(st)
+		default:
+			if r >= ' ' {
+				st.buf = append(st.buf[:st.pos], append([]rune{r}, st.buf[st.pos:]...)...)
+				st.pos++
+			}
+		}
+		e.refresh(st)
+	}
+}
+
+func (st *editState) left() {
+	if st.pos > 0 {
+		st.pos--
+	}
+}
+
+func (st *editState) right() {
+	if st.pos < len(st.buf) {
+		st.pos++
+	}
+}
+
+func (st *editState) deleteChar() {
+	if st.pos < len(st.buf) {
+		st.buf = append(st.buf[:st.pos], st.buf[st.pos+1:]...)
+	}
+}
+
+func (e *lineEditor) refresh(st *editState) {
+	out := "\r" + st.prompt + string(st.buf) + "\x1b[K"
+	if back := len(st.buf) - st.pos; back > 0 {
+		out += fmt.Sprintf("\x1b[%dD", back)
+	}
+	fmt.Print(out)
+}
+
+func (e *lineEditor) escape(st *editState) {
+	r, _, err := stdin.ReadRune()
+	if err != nil || (r != '[' && r != 'O') {
+		return
+	}
+	r, _, err = stdin.ReadRune()
+	if err != nil {
+		return
+	}
+
+	switch r {
+	case 'A':
+		e.historyMove(st, -1)
+	case 'B':
+		e.historyMove(st, 1)
+	case 'C':
+		st.right()
+	case 'D':
+		st.left()
+	case 'H':
+		st.pos = 0
+	case 'F':
+		st.pos = len(st.buf)
+	default:
+		if r < '0' || r > '9' {
+			return
+		}
+		// Sequences like ESC [ 3 ~
+		code := string(r)
+		for {
+			r, _, err = stdin.ReadRune()
+			if err != nil || r == '~' {
+				break
+			}
+			code += string(r)
+		}
+		switch code {
+		case "1", "7":
+			st.pos = 0
+		case "4", "8":
+			st.pos = len(st.buf)
+		case "3":
+			st.deleteChar()
+		}
+	}
+}
+
+// historyMove ...
+// Moves dir lines through the history, keeping whatever was being typed so
+// that it comes back when moving past the newest line.
+func (e *lineEditor) historyMove(st *editState, dir int) {
+	next := st.hist + dir
+	if next < 0 || next > len(e.history) {
+		return
+	}
+	if st.hist == len(e.history) {
+		st.pending = st.buf
+	}
+	st.hist = next
+	if next == len(e.history) {
+		st.buf = st.pending
+	} else {
+		st.buf = []rune(e.history[next])
+	}
+	st.pos = len(st.buf)
+}
+
+// search ...
+// Incrementally searches backwards through the history (Ctrl-R). Returns
+// true if Enter was pressed to run the line that was found.
+func (e *lineEditor) search(st *editState) bool {
+	query := []rune{}
+	found := len(e.history)
+	failing := false
+
+	find := func(from int) {
+		for i := from; i >= 0 && i < len(e.history); i-- {
+			if strings.Contains(e.history[i], string(query)) {
+				found = i
+				failing = false
+				return
+			}
+		}
+		failing = true
+	}
+
+	for {
+		match := ""
+		if found < len(e.history) {
+			match = e.history[found]
+		}
+		status := "reverse-i-search"
+		if failing {
+			status = "failing " + status
+		}
+		fmt.Printf("\r(%s)`%s': %s\x1b[K", status, string(query), match)
+
+		r, _, err := stdin.ReadRune()
+		if err != nil {
+			return false
+		}
+		switch r {
+		case 18: // Ctrl-R finds the next older match
+			find(found - 1)
+		case 8, 127:
+			if len(query) > 0 {
+				query = query[:len(query)-1]
+				find(len(e.history) - 1)
+			}
+		case 3, 7: // Ctrl-C and Ctrl-G give up
+			return false
+		case '\r', '\n':
+			if match != "" {
+				st.buf = []rune(match)
+				st.pos = len(st.buf)
+			}
+			return true
+		default:
+			if r >= ' ' {
+				query = append(query, r)
+				if found == len(e.history) {
+					find(len(e.history) - 1)
+				} else {
+					find(found)
+				}
+				continue
+			}
+			// Any other key stops searching, keeping the match to edit
+			if match != "" {
+				st.buf = []rune(match)
+				st.pos = len(st.buf)
+				st.hist = found
+			}
+			if r == 27 {
+				e.escape(st)
+			}
+			return false
+		}
+	}
+}
+
+// completeWord ...
+// Completes the word before the cursor as far as all of the possibilities
+// agree, or lists them if that doesn't get any further.
+func (e *lineEditor) completeWord(st *editState) {
+	start := st.pos
+	for start > 0 && st.buf[start-1] != ' ' {
+		start--
+	}
+	word := string(st.buf[start:st.pos])
+	if word == "" || e.complete == nil {
+		return
+	}
+
+	options := e.complete(word)
+	if len(options) == 0 {
+		fmt.Print("\a")
+		return
+	}
+
+	prefix := options[0]
+	for _, option := range options[1:] {
+		i := 0
+		for i < len(prefix) && i < len(option) && prefix[i] == option[i] {
+			i++
+		}
+		prefix = prefix[:i]
+	}
+	if len(options) == 1 {
+		prefix += " "
+	}
+
+	if len(prefix) > len(word) {
+		st.buf = append(st.buf[:start], append([]rune(prefix), st.buf[st.pos:]...)...)
+		st.pos = start + len([]rune(prefix))
+		return
+	}
+	fmt.Print("\r\n" + strings.Join(options, "  ") + "\r\n")
+}
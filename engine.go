@@ -0,0 +1,245 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"os/signal"
+	"sync/atomic"
+)
+
+// stepMode ...
+// How far the program runs when it's continued
+type stepMode int
+
+const (
+	stepNone stepMode = iota
+	stepInto          // STEP: stop before the next line, even inside a call
+	stepOver          // NEXT: stop before the next line at the same depth
+	stepOut           // stop once the current call has returned
+)
+
+// stopReason ...
+// Why a program paused
+type stopReason int
+
+const (
+	reasonInterrupt stopReason = iota
+	reasonStop
+	reasonStep
+	reasonBreakpoint
+	reasonWatch
+	reasonRestore
+)
+
+// execution ...
+// A RUN started from the REPL or a debugger. The program runs in its own
+// goroutine, so that it can be paused anywhere, even inside a FUNCTION, and
+// continued later. running, step and depth are only written by whatever
+// started it, while the program is paused. index is the line it's paused
+// before, or at if reason is reasonStop.
+type execution struct {
+	stops   chan stop
+	resume  chan bool
+	index   int
+	reason  stopReason
+	running bool
+	step    stepMode
+	depth   int
+}
+
+// stop ...
+// Sent by the program when it pauses before line index, with a message saying
+// why, or when it's done.
+type stop struct {
+	index   int
+	reason  stopReason
+	message string
+	done    bool
+	err     error
+}
+
+var current *execution
+
+// interrupted is set to 1 when Ctrl-C is pressed
+var interrupted int32
+
+var errAbort = fmt.Errorf("Aborted")
+
+// watchInterrupts ...
+// Makes Ctrl-C break into the running program instead of killing ez.
+func watchInterrupts() {
+	c := make(chan os.Signal, 1)
+	signal.Notify(c, os.Interrupt)
+	go func() {
+		for range c {
+			atomic.StoreInt32(&interrupted, 1)
+		}
+	}()
+}
+
+// checkBreak ...
+// Called before each line is run, to see whether the program should pause.
+func checkBreak(index int) error {
+	if atomic.SwapInt32(&interrupted, 0) == 1 {
+		return pause(index, reasonInterrupt, fmt.Sprintf("BREAK IN %d", index))
+	}
+	if current == nil || !current.running {
+		return nil
+	}
+
+	switch {
+	case current.step == stepInto,
+		current.step == stepOver && len(callStack) <= current.depth,
+		current.step == stepOut && len(callStack) < current.depth:
+		return pause(index, reasonStep, lineListing(index))
+	case hasBreakpoint(index):
+		return pause(index, reasonBreakpoint, fmt.Sprintf("BREAKPOINT AT %d\n%s", index, lineListing(index)))
+	}
+	for _, w := range watches {
+		if v, err := evalOperand(w.t); err == nil && v != w.last {
+			message := fmt.Sprintf("%s CHANGED FROM %s TO %s\n%s", w.t.StringData, w.last.literal(), v.literal(), lineListing(index))
+			w.last = v
+			return pause(index, reasonWatch, message)
+		}
+	}
+	return nil
+}
+
+// pause ...
+// Pauses the program before line index, and waits until it's continued. If
+// the program wasn't started by RUN, there's no way to continue it, so it
+// stops instead, with message as the error.
+func pause(index int, reason stopReason, message string) error {
+	if current == nil || !current.running {
+		return fmt.Errorf("%s", message)
+	}
+	current.stops <- stop{index: index, reason: reason, message: message}
+	if !<-current.resume {
+		return errAbort
+	}
+	return nil
+}
+
+// launchExecution ...
+// Starts running the program from the start, without waiting for it. With
+// stepInto, it pauses before the first line.
+func launchExecution(step stepMode) {
+	abortExecution()
+	atomic.StoreInt32(&interrupted, 0)
+	updateWatches()
+
+	e := &execution{stops: make(chan stop), resume: make(chan bool), running: true, step: step}
+	current = e
+	go func() {
+		err := prepareRun()
+		if err == nil {
+			err = run(0, 0)
+		}
+		e.stops <- stop{done: true, err: err}
+	}()
+}
+
+// restoreExecution ...
+// Pauses the program before line index, with whatever calls are already on
+// the call stack, as if it had stopped there. Used by LOADSTATE.
+func restoreExecution(index int) {
+	abortExecution()
+	atomic.StoreInt32(&interrupted, 0)
+	updateWatches()
+
+	e := &execution{stops: make(chan stop), resume: make(chan bool), running: true}
+	current = e
+	go func() {
+		err := pause(index, reasonRestore, "")
+		if err == nil {
+			err = run(index, 0)
+		}
+		e.stops <- stop{done: true, err: err}
+	}()
+	stopped(<-e.stops)
+}
+
+// resumeExecution ...
+// Continues the paused program, without waiting for it.
+func resumeExecution(step stepMode) {
+	atomic.StoreInt32(&interrupted, 0)
+	updateWatches()
+	current.step = step
+	current.depth = len(callStack)
+	current.running = true
+	current.resume <- true
+}
+
+// runningStops ...
+// Returns the channel to wait on for the running program to stop, or nil if
+// there's no program running.
+func runningStops() chan stop {
+	if current == nil || !current.running {
+		return nil
+	}
+	return current.stops
+}
+
+// stopped ...
+// Keeps track of a stop received from the program.
+func stopped(s stop) {
+	current.running = false
+	if s.done {
+		current = nil
+		resetCalls()
+		return
+	}
+	current.index, current.reason = s.index, s.reason
+}
+
+// abortExecution ...
+// Ends a paused program for good.
+func abortExecution() {
+	if current == nil {
+		return
+	}
+	current.running = true
+	current.resume <- false
+	stopped(<-current.stops)
+}
+
+// startExecution ...
+// RUN from the REPL, or STEP and NEXT when no program is paused, which stop
+// before the first line.
+func startExecution(step stepMode) {
+	launchExecution(step)
+	waitExecution()
+}
+
+// continueExecution ...
+// CONT, STEP or NEXT from the REPL
+func continueExecution(step stepMode) {
+	if current == nil {
+		if step == stepNone {
+			fmt.Println("CAN'T CONTINUE")
+		} else {
+			startExecution(step)
+		}
+		return
+	}
+	resumeExecution(step)
+	waitExecution()
+}
+
+// waitExecution ...
+// Waits until the program pauses or finishes, and says which.
+func waitExecution() {
+	s := <-current.stops
+	stopped(s)
+	if s.done {
+		if s.err != nil && s.err != errEnd && s.err != errAbort {
+			fmt.Println(s.err.Error())
+		}
+		return
+	}
+	if s.reason == reasonInterrupt {
+		// Move past the ^C echoed by the terminal
+		fmt.Println()
+	}
+	fmt.Println(s.message)
+}
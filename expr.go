@@ -0,0 +1,217 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+)
+
+// value ...
+// The result of evaluating an expression; either a string or an integer
+type value struct {
+	isStr bool
+	i     int
+	s     string
+}
+
+func (v value) String() string {
+	if v.isStr {
+		return v.s
+	}
+	return strconv.Itoa(v.i)
+}
+
+// literal ...
+// Returns v as it would be written in a program, with quotes around strings.
+func (v value) literal() string {
+	if v.isStr {
+		return fmt.Sprintf("\"%s\"", v.s)
+	}
+	return strconv.Itoa(v.i)
+}
+
+func evalOperand(t Token) (value, error) {
+	switch t.Type {
+	case TokenConstInt:
+		return value{i: t.IntData}, nil
+	case TokenConstStr:
+		return value{isStr: true, s: t.StringData}, nil
+	case TokenIdentInt:
+		return value{i: getInt(t.StringData)}, nil
+	case TokenIdentStr:
+		return value{isStr: true, s: getStr(t.StringData)}, nil
+	case TokenCall:
+		return callFunction(t)
+	default:
+		return value{}, fmt.Errorf("Unexpected token in expression: %s", t.String())
+	}
+}
+
+// function ...
+// A single-expression function defined with DEF FN
+type function struct {
+	params []Token
+	body   []Token
+}
+
+var functions = make(map[string]*function)
+
+func defineFunction(l []Token) {
+	fn := &function{params: []Token{}}
+	for i, token := range l[1:] {
+		if token.Type == TokenEq {
+			fn.body = l[i+2:]
+			break
+		} else if token.Type != TokenComma {
+			fn.params = append(fn.params, token)
+		}
+	}
+	functions[l[0].StringData] = fn
+}
+
+func callFunction(t Token) (value, error) {
+	fn, ok := functions[t.StringData]
+	if !ok {
+		if _, ok := procedures[t.StringData]; ok {
+			return callProcedure(t)
+		}
+		return value{}, fmt.Errorf("Undefined function %s", t.StringData)
+	}
+	if len(fn.params) != len(t.Args) {
+		return value{}, fmt.Errorf("%s expects %d arguments, got %d", t.StringData, len(fn.params), len(t.Args))
+	}
+
+	s := newScope()
+	for i, param := range fn.params {
+		v, err := evalExpr(t.Args[i])
+		if err != nil {
+			return value{}, err
+		}
+		if param.Type == TokenIdentStr && v.isStr {
+			s.strs[param.StringData] = v.s
+		} else if param.Type == TokenIdentInt && !v.isStr {
+			s.ints[param.StringData] = v.i
+		} else {
+			return value{}, fmt.Errorf("Type mismatch for parameter %s of %s", param.StringData, t.StringData)
+		}
+	}
+
+	if err := pushScope(s); err != nil {
+		return value{}, err
+	}
+	defer popScope()
+
+	v, err := evalExpr(fn.body)
+	if err != nil {
+		return value{}, err
+	}
+	_, stringp := validIdentifierStrP(t.StringData)
+	if v.isStr != stringp {
+		return value{}, fmt.Errorf("Type mismatch in result of %s", t.StringData)
+	}
+	return v, nil
+}
+
+// evalExpr ...
+// Evaluates a list of operands separated by operators, strictly left to right.
+func evalExpr(l []Token) (value, error) {
+	if len(l) == 0 {
+		return value{}, fmt.Errorf("Expected an expression")
+	}
+
+	acc, err := evalOperand(l[0])
+	if err != nil {
+		return value{}, err
+	}
+
+	for i := 1; i < len(l); i += 2 {
+		if !isOperatorType(l[i].Type) {
+			return value{}, fmt.Errorf("Expected an operator, got %s", l[i].String())
+		}
+		if i+1 >= len(l) {
+			return value{}, fmt.Errorf("Expected an operand after %s", l[i].String())
+		}
+		r, err := evalOperand(l[i+1])
+		if err != nil {
+			return value{}, err
+		}
+		acc, err = applyOp(acc, l[i].Type, r)
+		if err != nil {
+			return value{}, err
+		}
+	}
+	return acc, nil
+}
+
+func applyOp(l value, op TokenType, r value) (value, error) {
+	if l.isStr || r.isStr {
+		if l.isStr && r.isStr && op == TokenAdd {
+			return value{isStr: true, s: l.s + r.s}, nil
+		}
+		return value{}, fmt.Errorf("Tried to perform an illegal string operation")
+	}
+
+	switch op {
+	case TokenAdd:
+		return value{i: l.i + r.i}, nil
+	case TokenSub:
+		return value{i: l.i - r.i}, nil
+	case TokenMul:
+		return value{i: l.i * r.i}, nil
+	case TokenDiv:
+		if r.i == 0 {
+			return value{}, fmt.Errorf("Division by zero")
+		}
+		return value{i: l.i / r.i}, nil
+	case TokenAnd:
+		return value{i: l.i & r.i}, nil
+	case TokenOr:
+		return value{i: l.i | r.i}, nil
+	case TokenXor:
+		return value{i: l.i ^ r.i}, nil
+	default:
+		return value{}, fmt.Errorf("Tried to perform an illegal integer operation")
+	}
+}
+
+// compareValues ...
+// Compares two values with the comparison operator op. When comparing a
+// string with an integer, the length of the string is used.
+func compareValues(l value, op Token, r value) (bool, error) {
+	if l.isStr && !r.isStr {
+		l = value{i: len(l.s)}
+	} else if !l.isStr && r.isStr {
+		r = value{i: len(r.s)}
+	}
+
+	cmp := 0
+	if l.isStr {
+		if l.s < r.s {
+			cmp = -1
+		} else if l.s > r.s {
+			cmp = 1
+		}
+	} else {
+		if l.i < r.i {
+			cmp = -1
+		} else if l.i > r.i {
+			cmp = 1
+		}
+	}
+
+	switch op.Type {
+	case TokenEq:
+		return cmp == 0, nil
+	case TokenNe:
+		return cmp != 0, nil
+	case TokenGt:
+		return cmp > 0, nil
+	case TokenLt:
+		return cmp < 0, nil
+	case TokenGtEq:
+		return cmp >= 0, nil
+	case TokenLtEq:
+		return cmp <= 0, nil
+	default:
+		return false, fmt.Errorf("Not a comparison operator: %s", op.String())
+	}
+}
@@ -0,0 +1,255 @@
+package main
+
+import (
+	"strings"
+)
+
+// unknownLine ...
+// Where a computed GOTO or GOSUB goes in the control flow graph
+const unknownLine = -1
+
+// flowKind ...
+// How execution gets from one line of a program to another
+type flowKind int
+
+const (
+	flowNext     flowKind = iota // on to the line which runs next
+	flowJump                     // GOTO or GOSUB, or a SELECT picking a CASE
+	flowCall                     // CALL of a SUB, to its declaration
+	flowFunction                 // a FUNCTION called from an expression, which returns to the line
+	flowReturn                   // on to the line which runs once a GOSUB or CALL returns
+	flowComputed                 // GOTO or GOSUB a line number in a variable, to unknownLine
+)
+
+// flowStops ...
+// Returned by findJumps for a statement which never goes on to the next line
+const flowStops flowKind = -1
+
+// flowEdge ...
+// A way execution can go from one line of a program to another, labelled
+// with how, e.g. THEN GOTO. proc is the SUB or FUNCTION called by a flowCall
+// or flowFunction edge, or returned from by a flowReturn edge after a CALL.
+type flowEdge struct {
+	from, to int
+	label    string
+	kind     flowKind
+	proc     string
+}
+
+// dashed ...
+// Whether the edge isn't a jump to a line: a computed jump, which goes to
+// unknownLine, or a FUNCTION called from an expression, which returns to the
+// line.
+func (e flowEdge) dashed() bool {
+	return e.kind == flowFunction || e.kind == flowComputed
+}
+
+// nextUsed ...
+// Returns the index of the line after line index, or -1 if there isn't one.
+func nextUsed(prog []*Line, index int) int {
+	for i := index + 1; i < len(prog); i++ {
+		if prog[i] != nil && prog[i].Used {
+			return i
+		}
+	}
+	return -1
+}
+
+// flowGraph ...
+// The control flow graph of a program, found by buildFlow. entry is the first
+// line run, and warnings are the problems found on the way, such as jumps to
+// lines which don't exist.
+type flowGraph struct {
+	prog     []*Line
+	entry    int
+	edges    []flowEdge
+	warnings []warning
+}
+
+// buildFlow ...
+// Finds the edges of the control flow graph of a program, a line at a time.
+// Used by ez check and ez dot, so that they agree. Uses procedures and labels,
+// so indexProcedures and indexLabels must have been called for prog.
+func buildFlow(prog []*Line) *flowGraph {
+	g := &flowGraph{prog: prog}
+	g.entry = g.fallTo(-1)
+	for i, line := range prog {
+		if line != nil && line.Used {
+			g.findEdges(i)
+		}
+	}
+	return g
+}
+
+// fallTo ...
+// Returns the line run after line index if it doesn't jump: SUBs, FUNCTIONs
+// and TESTs are skipped over, and reaching a CASE ends the CASE before it.
+func (g *flowGraph) fallTo(index int) int {
+	i := nextUsed(g.prog, index)
+	for i != -1 {
+		var end int
+		var err error
+		switch g.prog[i].Tokens[0].Type {
+		case TokenSubroutine, TokenFunction:
+			end, err = skipProcedure(g.prog, i)
+		case TokenTest:
+			end, err = skipTest(g.prog, i)
+		case TokenCase, TokenCaseElse:
+			end, err = endSelect(g.prog, i)
+			if err == nil {
+				return end
+			}
+		default:
+			return i
+		}
+		if err != nil {
+			return -1
+		}
+		i = nextUsed(g.prog, end)
+	}
+	return -1
+}
+
+func (g *flowGraph) add(from, to int, label string, kind flowKind, proc string) {
+	if to != -1 || kind == flowComputed {
+		g.edges = append(g.edges, flowEdge{from, to, label, kind, proc})
+	}
+}
+
+func (g *flowGraph) warn(index int, message string) {
+	g.warnings = append(g.warnings, warning{index, message})
+}
+
+// findEdges ...
+// Adds the edges leaving line index. The declaration of a SUB, FUNCTION or
+// TEST leads into its body, which only runs when it's called or tested.
+func (g *flowGraph) findEdges(index int) {
+	l := g.prog[index].Tokens
+	switch l[0].Type {
+	case TokenSubroutine, TokenFunction:
+		g.add(index, nextUsed(g.prog, index), "", flowNext, "")
+		return
+	case TokenTest:
+		if _, err := skipTest(g.prog, index); err != nil {
+			g.warn(index, err.Error())
+		}
+		g.add(index, nextUsed(g.prog, index), "", flowNext, "")
+		return
+	case TokenCase, TokenCaseElse:
+		if _, err := endSelect(g.prog, index); err != nil {
+			g.warn(index, err.Error())
+		}
+		next := nextUsed(g.prog, index)
+		if next != -1 && (g.prog[next].Tokens[0].Type == TokenCase || g.prog[next].Tokens[0].Type == TokenCaseElse) {
+			next = g.fallTo(index)
+		}
+		g.add(index, next, "", flowNext, "")
+		return
+	case TokenSelect:
+		g.findCases(index)
+		return
+	}
+
+	for _, call := range calls(l) {
+		if proc, ok := procedures[call.StringData]; ok && proc.function {
+			g.add(index, proc.start, call.StringData, flowFunction, call.StringData)
+		}
+	}
+	if kind, proc := g.findJumps(index, l, ""); kind != flowStops {
+		g.add(index, g.fallTo(index), "", kind, proc)
+	}
+}
+
+// findCases ...
+// Adds an edge from the SELECT CASE on line index to each of its CASEs, and
+// to its END SELECT if there's no CASE ELSE.
+func (g *flowGraph) findCases(index int) {
+	depth := 0
+	caseElse := false
+	for i := index + 1; i < len(g.prog); i++ {
+		if g.prog[i] == nil || !g.prog[i].Used {
+			continue
+		}
+		switch g.prog[i].Tokens[0].Type {
+		case TokenSelect:
+			depth++
+		case TokenEndSelect:
+			if depth == 0 {
+				if !caseElse {
+					g.add(index, i, "no match", flowJump, "")
+				}
+				return
+			}
+			depth--
+		case TokenCase, TokenCaseElse:
+			if depth == 0 {
+				g.add(index, i, "", flowJump, "")
+				caseElse = caseElse || g.prog[i].Tokens[0].Type == TokenCaseElse
+			}
+		}
+	}
+	g.warn(index, "SELECT CASE without END SELECT")
+}
+
+// findJumps ...
+// Adds the edges for the jumps in statement l on line index, with labels
+// starting with prefix. Returns how it goes on to the next line: flowNext,
+// flowReturn and the SUB called if it's a GOSUB or CALL, or flowStops.
+func (g *flowGraph) findJumps(index int, l []Token, prefix string) (flowKind, string) {
+	switch l[0].Type {
+	case TokenIf:
+		thenPos, elsePos := ifParts(l)
+		then := l[thenPos+1:]
+		if elsePos != -1 {
+			then = l[thenPos+1 : elsePos]
+		}
+		if kind, proc := g.findJumps(index, then, prefix+" THEN"); kind != flowStops {
+			g.add(index, g.fallTo(index), strings.TrimSpace(prefix+" THEN"), kind, proc)
+		}
+		if elsePos == -1 {
+			g.add(index, g.fallTo(index), strings.TrimSpace(prefix+" ELSE"), flowNext, "")
+		} else if kind, proc := g.findJumps(index, l[elsePos+1:], prefix+" ELSE"); kind != flowStops {
+			g.add(index, g.fallTo(index), strings.TrimSpace(prefix+" ELSE"), kind, proc)
+		}
+		return flowStops, ""
+	case TokenGoto, TokenGosub:
+		label := strings.TrimSpace(prefix + " " + strings.Fields(l[0].String())[0])
+		if l[0].StringData == "" {
+			if to := l[0].IntData; g.prog[to] == nil || !g.prog[to].Used {
+				g.warn(index, l[0].String()+" jumps to a line that doesn't exist")
+			}
+			g.add(index, l[0].IntData, label, flowJump, "")
+		} else if target, ok := labels[l[0].StringData]; ok {
+			g.add(index, target, label, flowJump, "")
+		} else {
+			g.add(index, unknownLine, label+" "+l[0].StringData, flowComputed, "")
+		}
+		if l[0].Type == TokenGosub {
+			return flowReturn, ""
+		}
+		return flowStops, ""
+	case TokenCallSub:
+		if proc, ok := procedures[l[0].StringData]; ok {
+			g.add(index, proc.start, strings.TrimSpace(prefix+" "+formatTokens(l)), flowCall, l[0].StringData)
+			return flowReturn, l[0].StringData
+		}
+		g.warn(index, "Undefined procedure "+l[0].StringData)
+		return flowNext, ""
+	case TokenExit, TokenReturn, TokenEndSub, TokenExitSub, TokenEndFunction, TokenExitFunction, TokenEndTest:
+		return flowStops, ""
+	}
+	return flowNext, ""
+}
+
+// controlFlow ...
+// Returns the control flow graph of a program. Uses indexProcedures and
+// indexLabels, so the program must have been parsed successfully.
+func controlFlow(prog []*Line) (*flowGraph, error) {
+	if err := indexProcedures(prog); err != nil {
+		return nil, err
+	}
+	if err := indexLabels(prog); err != nil {
+		return nil, err
+	}
+	return buildFlow(prog), nil
+}
@@ -0,0 +1,179 @@
+package main
+
+import (
+	"bytes"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"reflect"
+	"strconv"
+	"strings"
+)
+
+// FormatIndent ...
+// Indentation for each level of SUB, FUNCTION and SELECT CASE in formatted
+// programs
+const FormatIndent = "  "
+
+// joinTokens ...
+// Like tokensString, but with commas next to the token before them.
+func joinTokens(l []Token) string {
+	var b strings.Builder
+	for i, t := range l {
+		if i > 0 && t.Type != TokenComma {
+			b.WriteString(" ")
+		}
+		b.WriteString(t.String())
+	}
+	return b.String()
+}
+
+// formatTokens ...
+// Returns a statement in its canonical form, which lexes to the same tokens.
+func formatTokens(l []Token) string {
+	switch l[0].Type {
+	case TokenIf:
+		thenPos, elsePos := ifParts(l)
+		if elsePos == -1 {
+			return fmt.Sprintf("IF %s THEN %s", joinTokens(l[1:thenPos]), formatTokens(l[thenPos+1:]))
+		}
+		return fmt.Sprintf("IF %s THEN %s ELSE %s", joinTokens(l[1:thenPos]),
+			formatTokens(l[thenPos+1:elsePos]), formatTokens(l[elsePos+1:]))
+	case TokenDef:
+		eqPos := 1
+		for l[eqPos].Type != TokenEq {
+			eqPos++
+		}
+		return fmt.Sprintf("DEF %s(%s) = %s", l[0].StringData, joinTokens(l[1:eqPos]), joinTokens(l[eqPos+1:]))
+	case TokenSubroutine, TokenFunction:
+		if len(l) == 1 {
+			return l[0].String()
+		}
+		return fmt.Sprintf("%s(%s)", l[0].String(), joinTokens(l[1:]))
+	case TokenCallSub:
+		if len(l[0].Args) == 0 {
+			return "CALL " + l[0].StringData
+		}
+	}
+	return joinTokens(l)
+}
+
+// formatProgram ...
+// Re-emits a program in canonical form: upper case keywords, one space
+// between tokens, one space after line numbers, and the bodies of SUBs,
+// FUNCTIONs, CASEs and TESTs indented. Blank lines and REM lines are kept. The
+// program is parsed again afterwards, and it's an error if it doesn't give
+// exactly the same lines as before.
+func formatProgram(src []byte) ([]byte, []error) {
+	parsed, errs := parseProgram(bytes.NewReader(src))
+	if len(errs) > 0 {
+		return nil, errs
+	}
+	bySource := make(map[int]*Line)
+	for _, line := range parsed {
+		if line != nil {
+			bySource[line.Source] = line
+		}
+	}
+
+	var b bytes.Buffer
+	depth := 0
+	indent := func(d int) string {
+		if d < 0 {
+			d = 0
+		}
+		return strings.Repeat(FormatIndent, d)
+	}
+	for i, text := range strings.Split(strings.TrimRight(string(src), "\n"), "\n") {
+		text = strings.TrimSpace(text)
+		words := strings.Split(text, " ")
+		line, ok := bySource[i+1]
+		switch {
+		case text == "":
+			b.WriteString("\n")
+			continue
+		case strings.ToUpper(words[0]) == "REM":
+			fmt.Fprintf(&b, "%sREM%s\n", indent(depth), text[3:])
+			continue
+		case !ok:
+			// Replaced by a later line with the same number
+			b.WriteString(text + "\n")
+			continue
+		}
+
+		prefix := ""
+		if num, err := strconv.Atoi(words[0]); err == nil {
+			prefix = strconv.Itoa(num) + " "
+		}
+		if !line.Used {
+			b.WriteString(strings.TrimSpace(prefix) + "\n")
+			continue
+		}
+
+		d := depth
+		switch line.Tokens[0].Type {
+		case TokenSubroutine, TokenFunction, TokenSelect, TokenTest:
+			depth++
+		case TokenCase, TokenCaseElse:
+			d--
+		case TokenEndSub, TokenEndFunction, TokenEndSelect, TokenEndTest:
+			depth--
+			d--
+		}
+		fmt.Fprintf(&b, "%s%s%s\n", prefix, indent(d), formatTokens(line.Tokens))
+	}
+
+	formatted := b.Bytes()
+	reparsed, errs := parseProgram(bytes.NewReader(formatted))
+	if len(errs) > 0 {
+		return nil, errs
+	}
+	for num := range parsed {
+		if (parsed[num] == nil) != (reparsed[num] == nil) ||
+			parsed[num] != nil && (parsed[num].Used != reparsed[num].Used ||
+				!reflect.DeepEqual(parsed[num].Tokens, reparsed[num].Tokens)) {
+			return nil, []error{fmt.Errorf("%d: Formatting would change this line", num)}
+		}
+	}
+	return formatted, nil
+}
+
+// formatCommand ...
+// ez fmt [-w] file... prints programs in canonical form, or with -w rewrites
+// the files which aren't already.
+func formatCommand(args []string) {
+	flags := flag.NewFlagSet("fmt", flag.ExitOnError)
+	write := flags.Bool("w", false, "write the result back to the file instead of printing it")
+	flags.Parse(args)
+	if flags.NArg() == 0 {
+		fmt.Fprintln(os.Stderr, "Usage: ez fmt [-w] file...")
+		os.Exit(2)
+	}
+
+	status := 0
+	for _, name := range flags.Args() {
+		src, err := ioutil.ReadFile(name)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err.Error())
+			status = 1
+			continue
+		}
+		formatted, errs := formatProgram(src)
+		if len(errs) > 0 {
+			reportParseErrors(os.Stderr, name, errs)
+			status = 1
+			continue
+		}
+
+		if !*write {
+			os.Stdout.Write(formatted)
+		} else if !bytes.Equal(src, formatted) {
+			if err := ioutil.WriteFile(name, formatted, 0644); err != nil {
+				fmt.Fprintln(os.Stderr, err.Error())
+				status = 1
+			}
+		}
+	}
+	os.Exit(status)
+}
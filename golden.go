@@ -0,0 +1,320 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+var errTimeout = fmt.Errorf("Timed out")
+
+var errEndTest = fmt.Errorf("END TEST outside of a TEST")
+
+// testResult ...
+// The outcome of a TEST block run by ez test, and what it printed
+type testResult struct {
+	name   string
+	err    error
+	output []byte
+}
+
+// skipTest ...
+// Returns the index of the END TEST closing the TEST on line index, so that
+// tests are skipped over outside of ez test.
+func skipTest(lines []*Line, index int) (int, error) {
+	for i := index + 1; i < len(lines); i++ {
+		if lines[i] == nil || !lines[i].Used {
+			continue
+		}
+		switch lines[i].Tokens[0].Type {
+		case TokenEndTest:
+			return i, nil
+		case TokenTest:
+			return 0, fmt.Errorf("%d: TEST inside TEST", i)
+		}
+	}
+	return 0, fmt.Errorf("%d: TEST without END TEST", index)
+}
+
+// indexTests ...
+// Returns the lines of the TEST blocks in the program, in order.
+func indexTests(lines []*Line) ([]int, error) {
+	tests := []int{}
+	for i, line := range lines {
+		if line == nil || !line.Used || line.Tokens[0].Type != TokenTest {
+			continue
+		}
+		if _, err := skipTest(lines, i); err != nil {
+			return nil, err
+		}
+		tests = append(tests, i)
+	}
+	return tests, nil
+}
+
+// timed ...
+// Calls fn, breaking into the program as if by Ctrl-C if it takes longer than
+// timeout, in which case errTimeout is returned.
+func timed(timeout time.Duration, fn func() error) error {
+	atomic.StoreInt32(&interrupted, 0)
+	timer := time.AfterFunc(timeout, func() { atomic.StoreInt32(&interrupted, 1) })
+	err := fn()
+	finished := timer.Stop()
+	atomic.StoreInt32(&interrupted, 0)
+	if !finished {
+		return errTimeout
+	}
+	return err
+}
+
+// runTests ...
+// Runs each TEST block in the loaded program on its own, from its first line
+// to END TEST, with no variables set. A test passes if it gets there, or to
+// END, without an error.
+func runTests(timeout time.Duration) ([]testResult, error) {
+	tests, err := indexTests(lines)
+	if err != nil {
+		return nil, err
+	}
+	results := []testResult{}
+	for _, index := range tests {
+		var buf bytes.Buffer
+		output = &buf
+		clearVars()
+		err := timed(timeout, func() error {
+			if err := prepareRun(); err != nil {
+				return err
+			}
+			return run(index+1, 0)
+		})
+		resetCalls()
+		if err == errEndTest || err == errEnd {
+			err = nil
+		}
+		results = append(results, testResult{lines[index].Tokens[0].StringData, err, buf.Bytes()})
+	}
+	return results, nil
+}
+
+// runGolden ...
+// Runs the program in file path with in as its standard input, and returns
+// everything it printed, including errors, then the results of its TEST
+// blocks. The program is loaded from scratch, with no variables, as if by LOAD
+// then RUN. Returns errTimeout if it had to be broken into after timeout.
+func runGolden(path string, in []byte, timeout time.Duration) ([]byte, []testResult, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer file.Close()
+
+	var buf bytes.Buffer
+	savedOutput, savedStdin := output, stdin
+	savedTracing, savedTraceVars := tracing, traceVars
+	output = &buf
+	stdin = bufio.NewReader(bytes.NewReader(in))
+	defer func() {
+		output, stdin = savedOutput, savedStdin
+		tracing, traceVars = savedTracing, savedTraceVars
+	}()
+
+	clearProgram()
+	clearVars()
+	_, errs := loadProgram(file)
+	if len(errs) > 0 {
+		for _, err := range errs {
+			fmt.Fprintln(&buf, err.Error())
+		}
+		return buf.Bytes(), nil, nil
+	}
+
+	err = timed(timeout, func() error {
+		execLines(lines)
+		return nil
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+	results, err := runTests(timeout)
+	if err != nil {
+		fmt.Fprintln(&buf, err.Error())
+	}
+	return buf.Bytes(), results, nil
+}
+
+// diffLines ...
+// Returns the differences between want and got, one line each, prefixed
+// with - for lines only in want and + for lines only in got.
+func diffLines(want, got []byte) string {
+	a := strings.SplitAfter(string(want), "\n")
+	b := strings.SplitAfter(string(got), "\n")
+
+	// lcs[i][j] is the length of the longest common subsequence of a[i:]
+	// and b[j:]
+	lcs := make([][]int, len(a)+1)
+	for i := range lcs {
+		lcs[i] = make([]int, len(b)+1)
+	}
+	for i := len(a) - 1; i >= 0; i-- {
+		for j := len(b) - 1; j >= 0; j-- {
+			if a[i] == b[j] {
+				lcs[i][j] = lcs[i+1][j+1] + 1
+			} else if lcs[i+1][j] >= lcs[i][j+1] {
+				lcs[i][j] = lcs[i+1][j]
+			} else {
+				lcs[i][j] = lcs[i][j+1]
+			}
+		}
+	}
+
+	var ret strings.Builder
+	line := func(prefix, text string) {
+		if text == "" {
+			return
+		}
+		if !strings.HasSuffix(text, "\n") {
+			text += "\n\\ No newline at end\n"
+		}
+		ret.WriteString(prefix + text)
+	}
+	i, j := 0, 0
+	for i < len(a) || j < len(b) {
+		switch {
+		case i < len(a) && j < len(b) && a[i] == b[j]:
+			line("  ", a[i])
+			i++
+			j++
+		case j == len(b) || i < len(a) && lcs[i+1][j] >= lcs[i][j+1]:
+			line("- ", a[i])
+			i++
+		default:
+			line("+ ", b[j])
+			j++
+		}
+	}
+	return ret.String()
+}
+
+// testCommand ...
+// ez test [-update] [dir] runs each .bas file under dir, with the .in file
+// next to it as its input if there is one, and compares what it prints with
+// the .out file next to it. With -update, the .out files are written instead.
+// Then it runs the program's TEST blocks. Exits with status 1 if any program's
+// output doesn't match, or any TEST fails. With -cover or -cover-html, it
+// also shows which lines of each program ran, during the program and its tests.
+func testCommand(args []string) {
+	flags := flag.NewFlagSet("test", flag.ExitOnError)
+	update := flags.Bool("update", false, "write the output of each program to its .out file")
+	timeout := flags.Duration("timeout", 10*time.Second, "break into programs which run for longer than this")
+	cover := flags.Bool("cover", false, "show how many lines, and ways through IFs, of each program ran")
+	coverHTML := flags.String("cover-html", "", "write each program to this directory as HTML, showing which lines ran")
+	flags.Parse(args)
+	dir := "."
+	if flags.NArg() > 1 {
+		fmt.Fprintln(os.Stderr, "Usage: ez test [-update] [-timeout d] [-cover] [-cover-html dir] [dir]")
+		os.Exit(2)
+	} else if flags.NArg() == 1 {
+		dir = flags.Arg(0)
+	}
+
+	covering = *cover || *coverHTML != ""
+	passed, failed, updated := 0, 0, 0
+	err := filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil || info.IsDir() || filepath.Ext(path) != ".bas" {
+			return err
+		}
+		base := strings.TrimSuffix(path, ".bas")
+		in, err := ioutil.ReadFile(base + ".in")
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		resetCoverage()
+		got, results, err := runGolden(path, in, *timeout)
+		if err == errTimeout {
+			fmt.Printf("FAIL %s: still running after %s\n", path, *timeout)
+			failed++
+			return nil
+		} else if err != nil {
+			return err
+		}
+		if *cover {
+			fmt.Printf("COVER %s: %s\n", path, coverageString())
+		}
+		if *coverHTML != "" {
+			rel, err := filepath.Rel(dir, base)
+			if err != nil {
+				return err
+			}
+			out := filepath.Join(*coverHTML, rel+".html")
+			if err := os.MkdirAll(filepath.Dir(out), 0755); err != nil {
+				return err
+			}
+			if err := saveCoverageHTML(out, path); err != nil {
+				return err
+			}
+		}
+
+		for _, r := range results {
+			switch {
+			case r.err == nil:
+				passed++
+				continue
+			case r.err == errTimeout:
+				fmt.Printf("FAIL %s: TEST \"%s\": still running after %s\n", path, r.name, *timeout)
+			default:
+				fmt.Printf("FAIL %s: TEST \"%s\": %s\n", path, r.name, r.err.Error())
+			}
+			if len(r.output) > 0 {
+				fmt.Printf("%s", r.output)
+				if !bytes.HasSuffix(r.output, []byte("\n")) {
+					fmt.Println()
+				}
+			}
+			failed++
+		}
+
+		// A program with TESTs only needs a .out file if it's been given one
+		if _, err := os.Stat(base + ".out"); len(results) > 0 && os.IsNotExist(err) {
+			return nil
+		}
+		if *update {
+			updated++
+			return ioutil.WriteFile(base+".out", got, 0644)
+		}
+		want, err := ioutil.ReadFile(base + ".out")
+		switch {
+		case os.IsNotExist(err):
+			fmt.Printf("FAIL %s: no %s.out; run ez test -update to create it\n", path, base)
+			failed++
+		case err != nil:
+			return err
+		case !bytes.Equal(want, got):
+			fmt.Printf("FAIL %s\n%s", path, diffLines(want, got))
+			failed++
+		default:
+			passed++
+		}
+		return nil
+	})
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err.Error())
+		os.Exit(1)
+	}
+
+	if *update {
+		fmt.Printf("Updated %d\n", updated)
+	}
+	if !*update || passed+failed > 0 {
+		fmt.Printf("%d passed, %d failed\n", passed, failed)
+	}
+	if failed > 0 {
+		os.Exit(1)
+	}
+}
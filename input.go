@@ -3,38 +3,51 @@ package main
 import (
 	"bufio"
 	"fmt"
+	"io"
 	"os"
 	"strconv"
+	"strings"
 )
 
+// stdin is shared by everything that reads standard input, so that nothing
+// is lost in the buffer of another reader.
+var stdin = bufio.NewReader(os.Stdin)
+
+// readInputLine ...
+// Reads a line from standard input, without the line ending
+func readInputLine() (string, error) {
+	text, err := stdin.ReadString('\n')
+	if err == io.EOF && text != "" {
+		err = nil
+	}
+	return strings.TrimRight(text, "\r\n"), err
+}
+
 // InputString ...
 // Prompts for a string
 func InputString(prompt string) (string, error) {
-	scanner := bufio.NewScanner(os.Stdin)
-	fmt.Print(prompt)
-	for scanner.Scan() {
-		return scanner.Text(), nil
+	fmt.Fprint(output, prompt)
+	text, err := readInputLine()
+	if err == io.EOF {
+		return "", nil
 	}
-	if err := scanner.Err(); err != nil {
-		return "", err
-	}
-	return "", nil
+	return text, err
 }
 
 // InputNumber ...
 // Prompts for an integer
 func InputNumber(prompt string) (int, error) {
-	scanner := bufio.NewScanner(os.Stdin)
-	fmt.Print(prompt)
-	for scanner.Scan() {
-		num, err := strconv.Atoi(scanner.Text())
+	for {
+		fmt.Fprint(output, prompt)
+		text, err := readInputLine()
+		if err == io.EOF {
+			return 0, nil
+		} else if err != nil {
+			return 0, err
+		}
+		num, err := strconv.Atoi(text)
 		if err == nil {
 			return num, nil
 		}
-		fmt.Print(prompt)
-	}
-	if err := scanner.Err(); err != nil {
-		return 0, err
 	}
-	return 0, nil
 }
@@ -39,17 +39,62 @@ const (
 	TokenAnd
 	TokenOr
 	TokenXor
+	TokenSelect
+	TokenCase
+	TokenCaseElse
+	TokenEndSelect
+	TokenTo
+	TokenIs
+	TokenComma
+	TokenDef
+	TokenCall
+	TokenSubroutine
+	TokenFunction
+	TokenEndSub
+	TokenEndFunction
+	TokenExitSub
+	TokenExitFunction
+	TokenCallSub
+	TokenLocal
+	TokenByRef
+	TokenGosub
+	TokenReturn
+	TokenLabel
+	TokenStop
+	TokenTron
+	TokenTroff
+	TokenAssert
+	TokenTest
+	TokenEndTest
 )
 
+// keywords ...
+// The keywords which can start a statement, plus those used inside statements
+var keywords = []string{
+	"ASSERT", "BYE", "BYREF", "BYVAL", "CALL", "CASE", "DEF", "ELSE", "END",
+	"EXIT", "FUNCTION", "GOSUB", "GOTO", "IF", "INPUT", "IS", "LET", "LOCAL",
+	"PRINT", "QUIT", "RETURN", "SELECT", "STOP", "SUB", "TEST", "THEN", "TO",
+	"TROFF", "TRON",
+}
+
 // Token ...
 type Token struct {
 	Type       TokenType
 	IntData    int
 	StringData string
+	Args       [][]Token
 }
 
 func isOperatorType(t TokenType) bool {
-	return t >= TokenAdd
+	return t >= TokenAdd && t <= TokenXor
+}
+
+func isComparisonType(t TokenType) bool {
+	return t >= TokenEq && t <= TokenLtEq
+}
+
+func isOperandType(t TokenType) bool {
+	return (t >= TokenIdentStr && t <= TokenConstInt) || t == TokenCall
 }
 
 func validIdentifierStrP(word string) (bool, bool) {
@@ -69,6 +114,16 @@ var errInvalidIf = fmt.Errorf("IF statements must be in the form IF...THEN or IF
 
 var errInvalidInput = fmt.Errorf("INPUT statements must be in the form INPUT PROMPT VAR")
 
+var errInvalidDef = fmt.Errorf("DEF statements must be in the form DEF FNNAME(PARAMS) = EXPR")
+
+var errInvalidCall = fmt.Errorf("CALL statements must be in the form CALL NAME or CALL NAME(ARGS)")
+
+var errInvalidAssert = fmt.Errorf("ASSERT statements must be in the form ASSERT EXPR OP EXPR or ASSERT EXPR OP EXPR, MESSAGE")
+
+var errInvalidTest = fmt.Errorf("TEST statements must be in the form TEST \"NAME\"")
+
+var errInvalidCase = fmt.Errorf("CASE statements must be in the form CASE ELSE, CASE IS OP EXPR, CASE EXPR TO EXPR or CASE EXPR, EXPR...")
+
 func lexOp(word string) *Token {
 	switch word {
 	case "+":
@@ -78,7 +133,7 @@ func lexOp(word string) *Token {
 	case "*":
 		return &Token{Type: TokenMul}
 	case "/":
-		return &Token{Type: TokenMul}
+		return &Token{Type: TokenDiv}
 	case "&":
 		return &Token{Type: TokenAnd}
 	case "|":
@@ -105,7 +160,7 @@ func lexOp(word string) *Token {
 func lexExpr(words []string) ([]Token, error) {
 	ret := make([]Token, 0, len(words))
 	snarf := -1
-	for i, word := range words {
+	for _, word := range words {
 		if snarf != -1 {
 			ret[snarf].StringData += " " + word
 			wl := len(ret[snarf].StringData)
@@ -113,6 +168,7 @@ func lexExpr(words []string) ([]Token, error) {
 				ret[snarf].StringData = ret[snarf].StringData[:wl-1]
 				snarf = -1
 			}
+			continue
 		}
 		op := lexOp(word)
 		if op != nil {
@@ -120,6 +176,15 @@ func lexExpr(words []string) ([]Token, error) {
 			continue
 		}
 
+		call, err := lexCall(word)
+		if err != nil {
+			return nil, err
+		}
+		if call != nil {
+			ret = append(ret, *call)
+			continue
+		}
+
 		valid, stringp := validIdentifierStrP(word)
 		if valid {
 			if stringp {
@@ -138,7 +203,7 @@ func lexExpr(words []string) ([]Token, error) {
 				ret = append(ret, Token{Type: TokenConstStr, StringData: word[1 : len(word)-1]})
 			} else {
 				ret = append(ret, Token{Type: TokenConstStr, StringData: word[1:]})
-				snarf = i
+				snarf = len(ret) - 1
 			}
 			continue
 		}
@@ -149,12 +214,217 @@ func lexExpr(words []string) ([]Token, error) {
 		}
 		ret = append(ret, Token{Type: TokenConstInt, IntData: num})
 	}
+	if snarf != -1 {
+		return nil, fmt.Errorf("Unterminated string")
+	}
+	return ret, nil
+}
+
+// splitCommas ...
+// Splits a comma-separated list, ignoring commas inside string constants and
+// parentheses.
+func splitCommas(text string) []string {
+	ret := []string{}
+	quoted := false
+	depth := 0
+	start := 0
+	for i, ru := range text {
+		switch {
+		case ru == '"':
+			quoted = !quoted
+		case quoted:
+		case ru == '(':
+			depth++
+		case ru == ')':
+			depth--
+		case ru == ',' && depth == 0:
+			ret = append(ret, strings.TrimSpace(text[start:i]))
+			start = i + 1
+		}
+	}
+	return append(ret, strings.TrimSpace(text[start:]))
+}
+
+// joinCalls ...
+// Rejoins function calls whose arguments were split up by spaces, so that each
+// call is a single word.
+func joinCalls(words []string) []string {
+	ret := make([]string, 0, len(words))
+	quoted := false
+	depth := 0
+	for _, word := range words {
+		if depth > 0 {
+			ret[len(ret)-1] += " " + word
+		} else {
+			ret = append(ret, word)
+		}
+		for _, ru := range word {
+			switch {
+			case ru == '"':
+				quoted = !quoted
+			case quoted:
+			case ru == '(':
+				depth++
+			case ru == ')' && depth > 0:
+				depth--
+			}
+		}
+	}
+	return ret
+}
+
+// lexCall ...
+// Lexes a function call such as FNsq(x + 1). Returns nil if the word isn't a
+// function call.
+func lexCall(word string) (*Token, error) {
+	open := strings.Index(word, "(")
+	if open <= 0 {
+		return nil, nil
+	}
+	name := word[:open]
+	if valid, _ := validIdentifierStrP(name); !valid {
+		return nil, nil
+	}
+	if word[len(word)-1] != ')' {
+		return nil, fmt.Errorf("Unbalanced parentheses in call to %s", name)
+	}
+
+	ret := &Token{Type: TokenCall, StringData: name, Args: [][]Token{}}
+	args := strings.TrimSpace(word[open+1 : len(word)-1])
+	if args == "" {
+		return ret, nil
+	}
+	for _, arg := range splitCommas(args) {
+		if arg == "" {
+			return nil, fmt.Errorf("Empty argument in call to %s", name)
+		}
+		expr, err := lexExpr(joinCalls(strings.Split(arg, " ")))
+		if err != nil {
+			return nil, err
+		}
+		ret.Args = append(ret.Args, expr)
+	}
+	return ret, nil
+}
+
+// findWord ...
+// Returns the index of the keyword kw in words, skipping over string
+// constants, or -1 if it isn't there.
+func findWord(words []string, kw string) int {
+	quoted := false
+	for i, word := range words {
+		if !quoted && strings.ToUpper(word) == kw {
+			return i
+		}
+		if strings.Count(word, "\"")%2 == 1 {
+			quoted = !quoted
+		}
+	}
+	return -1
+}
+
+func lexCaseClause(words []string) ([]Token, error) {
+	if len(words) == 0 || words[0] == "" {
+		return nil, errInvalidCase
+	}
+
+	if strings.ToUpper(words[0]) == "IS" {
+		if len(words) < 3 {
+			return nil, errInvalidCase
+		}
+		op := lexOp(words[1])
+		if op == nil || !isComparisonType(op.Type) {
+			return nil, fmt.Errorf("Not a comparison operator: %s", words[1])
+		}
+		expr, err := lexExpr(words[2:])
+		if err != nil {
+			return nil, err
+		}
+		return append([]Token{{Type: TokenIs}, *op}, expr...), nil
+	}
+
+	toPos := findWord(words, "TO")
+	if toPos == -1 {
+		return lexExpr(words)
+	}
+	if toPos == 0 || toPos == len(words)-1 {
+		return nil, errInvalidCase
+	}
+	lo, err := lexExpr(words[:toPos])
+	if err != nil {
+		return nil, err
+	}
+	hi, err := lexExpr(words[toPos+1:])
+	if err != nil {
+		return nil, err
+	}
+	ret := append(lo, Token{Type: TokenTo})
+	return append(ret, hi...), nil
+}
+
+// lexProcedure ...
+// Lexes the header of a SUB or FUNCTION declaration, e.g.
+// SUB swap(BYREF a, BYREF b) or FUNCTION greet$(n$)
+func lexProcedure(words []string) ([]Token, error) {
+	kw := strings.ToUpper(words[0])
+	errInvalid := fmt.Errorf("%s declarations must be in the form %s NAME or %s NAME(PARAMS)", kw, kw, kw)
+	if len(words) != 2 {
+		return nil, errInvalid
+	}
+
+	name := words[1]
+	params := ""
+	if open := strings.Index(name, "("); open != -1 {
+		if name[len(name)-1] != ')' {
+			return nil, errInvalid
+		}
+		params = strings.TrimSpace(name[open+1 : len(name)-1])
+		name = name[:open]
+	}
+	valid, string := validIdentifierStrP(name)
+	if !valid {
+		return nil, fmt.Errorf("Bad %s name %s", kw, name)
+	} else if string && kw == "SUB" {
+		return nil, fmt.Errorf("SUB names cannot end in $")
+	}
+
+	ret := []Token{{Type: TokenFunction, StringData: name}}
+	if kw == "SUB" {
+		ret[0].Type = TokenSubroutine
+	}
+	if params == "" {
+		return ret, nil
+	}
+	for i, param := range splitCommas(params) {
+		if i > 0 {
+			ret = append(ret, Token{Type: TokenComma})
+		}
+		pwords := strings.Split(param, " ")
+		if len(pwords) == 2 && strings.ToUpper(pwords[0]) == "BYREF" {
+			ret = append(ret, Token{Type: TokenByRef})
+			param = pwords[1]
+		} else if len(pwords) == 2 && strings.ToUpper(pwords[0]) == "BYVAL" {
+			param = pwords[1]
+		}
+		valid, string := validIdentifierStrP(param)
+		if !valid {
+			return nil, fmt.Errorf("Bad parameter %s", param)
+		} else if string {
+			ret = append(ret, Token{Type: TokenIdentStr, StringData: param})
+		} else {
+			ret = append(ret, Token{Type: TokenIdentInt, StringData: param})
+		}
+	}
 	return ret, nil
 }
 
 // Lex ...
 // Lexes the list of words. Returns a list of tokens, or non-nil error if it can't lex.
 func Lex(words []string) ([]Token, error) {
+	if len(words) == 0 || words[0] == "" {
+		return nil, fmt.Errorf("Expected a statement")
+	}
+	words = joinCalls(words)
 	ret := make([]Token, 0, len(words))
 	switch strings.ToUpper(words[0]) {
 	case "IF":
@@ -172,7 +442,7 @@ func Lex(words []string) ([]Token, error) {
 				elsePos = i + 1
 			}
 		}
-		if thenPos == -1 || (elsePos != -1 && elsePos < thenPos) {
+		if thenPos <= 1 || (elsePos != -1 && elsePos <= thenPos+1) {
 			return nil, errInvalidIf
 		}
 		ifexpr, err := lexExpr(words[1:thenPos])
@@ -208,17 +478,22 @@ func Lex(words []string) ([]Token, error) {
 			ret = append(ret, elseexpr...)
 		}
 		return ret, nil
-	case "GOTO":
+	case "GOTO", "GOSUB":
+		kw := strings.ToUpper(words[0])
+		t := TokenGoto
+		if kw == "GOSUB" {
+			t = TokenGosub
+		}
 		if len(words) == 1 {
-			return nil, fmt.Errorf("GOTO statement requires a line number")
+			return nil, fmt.Errorf("%s statement requires a line number or label", kw)
 		}
 
 		valid, string := validIdentifierStrP(words[1])
 		if valid {
 			if string {
-				return nil, fmt.Errorf("GOTO statement cannot use string variables")
+				return nil, fmt.Errorf("%s statement cannot use string variables", kw)
 			}
-			ret = append(ret, Token{Type: TokenGoto, StringData: words[1]})
+			ret = append(ret, Token{Type: t, StringData: words[1]})
 			break
 		}
 
@@ -226,12 +501,200 @@ func Lex(words []string) ([]Token, error) {
 		if err != nil {
 			return nil, fmt.Errorf("Bad line number \"%s\"; %s", words[1], err.Error())
 		} else if 0 <= num && num < MaxLines {
-			ret = append(ret, Token{Type: TokenGoto, IntData: num})
+			ret = append(ret, Token{Type: t, IntData: num})
 		} else {
 			return nil, fmt.Errorf("Line number must be in the range 0-%d", MaxLines)
 		}
+	case "RETURN":
+		if len(words) > 1 {
+			return nil, fmt.Errorf("RETURN takes no arguments")
+		}
+		ret = append(ret, Token{Type: TokenReturn})
+	case "STOP":
+		if len(words) > 1 {
+			return nil, fmt.Errorf("STOP takes no arguments")
+		}
+		ret = append(ret, Token{Type: TokenStop})
+	case "ASSERT":
+		parts := splitCommas(strings.Join(words[1:], " "))
+		if len(words) < 2 || len(parts) > 2 || parts[0] == "" {
+			return nil, errInvalidAssert
+		}
+		pred, err := lexExpr(joinCalls(strings.Split(parts[0], " ")))
+		if err != nil {
+			return nil, err
+		}
+		ret = append(ret, Token{Type: TokenAssert})
+		ret = append(ret, pred...)
+		if len(parts) == 2 {
+			if parts[1] == "" {
+				return nil, errInvalidAssert
+			}
+			message, err := lexExpr(joinCalls(strings.Split(parts[1], " ")))
+			if err != nil {
+				return nil, err
+			}
+			ret = append(ret, Token{Type: TokenComma})
+			ret = append(ret, message...)
+		}
+	case "TEST":
+		name := strings.Join(words[1:], " ")
+		if len(name) < 2 || name[0] != '"' || name[len(name)-1] != '"' || strings.Count(name, "\"") != 2 {
+			return nil, errInvalidTest
+		}
+		ret = append(ret, Token{Type: TokenTest, StringData: name[1 : len(name)-1]})
+	case "TRON":
+		if len(words) == 2 && strings.ToUpper(words[1]) == "VARS" {
+			ret = append(ret, Token{Type: TokenTron, StringData: "VARS"})
+			break
+		} else if len(words) > 1 {
+			return nil, fmt.Errorf("TRON takes no arguments other than VARS")
+		}
+		ret = append(ret, Token{Type: TokenTron})
+	case "TROFF":
+		if len(words) > 1 {
+			return nil, fmt.Errorf("TROFF takes no arguments")
+		}
+		ret = append(ret, Token{Type: TokenTroff})
 	case "EXIT", "QUIT", "BYE", "END":
+		if len(words) > 1 {
+			end := strings.ToUpper(words[0]) == "END"
+			switch strings.ToUpper(words[1]) {
+			case "SELECT":
+				if end {
+					ret = append(ret, Token{Type: TokenEndSelect})
+					return ret, nil
+				}
+			case "SUB":
+				if end {
+					ret = append(ret, Token{Type: TokenEndSub})
+				} else {
+					ret = append(ret, Token{Type: TokenExitSub})
+				}
+				return ret, nil
+			case "TEST":
+				if end {
+					ret = append(ret, Token{Type: TokenEndTest})
+					return ret, nil
+				}
+			case "FUNCTION":
+				if end {
+					ret = append(ret, Token{Type: TokenEndFunction})
+				} else {
+					ret = append(ret, Token{Type: TokenExitFunction})
+				}
+				return ret, nil
+			}
+		}
 		ret = append(ret, Token{Type: TokenExit})
+	case "SUB", "FUNCTION":
+		header, err := lexProcedure(words)
+		if err != nil {
+			return nil, err
+		}
+		ret = append(ret, header...)
+	case "CALL":
+		if len(words) != 2 {
+			return nil, errInvalidCall
+		}
+		call, err := lexCall(words[1])
+		if err != nil {
+			return nil, err
+		}
+		if call == nil {
+			if valid, string := validIdentifierStrP(words[1]); !valid || string {
+				return nil, errInvalidCall
+			}
+			call = &Token{StringData: words[1], Args: [][]Token{}}
+		}
+		call.Type = TokenCallSub
+		ret = append(ret, *call)
+	case "LOCAL":
+		if len(words) < 2 {
+			return nil, fmt.Errorf("LOCAL requires at least one variable")
+		}
+		ret = append(ret, Token{Type: TokenLocal})
+		for i, name := range splitCommas(strings.Join(words[1:], " ")) {
+			if i > 0 {
+				ret = append(ret, Token{Type: TokenComma})
+			}
+			valid, string := validIdentifierStrP(name)
+			if !valid {
+				return nil, fmt.Errorf("Bad identifier %s", name)
+			} else if string {
+				ret = append(ret, Token{Type: TokenIdentStr, StringData: name})
+			} else {
+				ret = append(ret, Token{Type: TokenIdentInt, StringData: name})
+			}
+		}
+	case "DEF":
+		eqPos := findWord(words, "=")
+		if eqPos < 2 || eqPos == len(words)-1 {
+			return nil, errInvalidDef
+		}
+		header := strings.Join(words[1:eqPos], " ")
+		open := strings.Index(header, "(")
+		if open <= 0 || header[len(header)-1] != ')' {
+			return nil, errInvalidDef
+		}
+		name := header[:open]
+		if valid, _ := validIdentifierStrP(name); !valid || !strings.HasPrefix(strings.ToUpper(name), "FN") {
+			return nil, fmt.Errorf("DEF function names must begin with FN")
+		}
+		ret = append(ret, Token{Type: TokenDef, StringData: name})
+		if params := strings.TrimSpace(header[open+1 : len(header)-1]); params != "" {
+			for i, param := range splitCommas(params) {
+				if i > 0 {
+					ret = append(ret, Token{Type: TokenComma})
+				}
+				valid, string := validIdentifierStrP(param)
+				if !valid {
+					return nil, fmt.Errorf("Bad parameter %s", param)
+				} else if string {
+					ret = append(ret, Token{Type: TokenIdentStr, StringData: param})
+				} else {
+					ret = append(ret, Token{Type: TokenIdentInt, StringData: param})
+				}
+			}
+		}
+		body, err := lexExpr(words[eqPos+1:])
+		if err != nil {
+			return nil, err
+		}
+		ret = append(ret, Token{Type: TokenEq})
+		ret = append(ret, body...)
+	case "SELECT":
+		if len(words) < 3 || strings.ToUpper(words[1]) != "CASE" {
+			return nil, fmt.Errorf("SELECT statements must be in the form SELECT CASE EXPR")
+		}
+		expr, err := lexExpr(words[2:])
+		if err != nil {
+			return nil, err
+		}
+		ret = append(ret, Token{Type: TokenSelect})
+		ret = append(ret, expr...)
+	case "CASE":
+		if len(words) < 2 {
+			return nil, errInvalidCase
+		}
+		if strings.ToUpper(words[1]) == "ELSE" {
+			if len(words) > 2 {
+				return nil, errInvalidCase
+			}
+			ret = append(ret, Token{Type: TokenCaseElse})
+			break
+		}
+		ret = append(ret, Token{Type: TokenCase})
+		for i, clause := range splitCommas(strings.Join(words[1:], " ")) {
+			if i > 0 {
+				ret = append(ret, Token{Type: TokenComma})
+			}
+			expr, err := lexCaseClause(strings.Split(clause, " "))
+			if err != nil {
+				return nil, err
+			}
+			ret = append(ret, expr...)
+		}
 	case "LET":
 		if len(words) < 4 {
 			return nil, fmt.Errorf("Expected at least one identifier in LET clause")
@@ -284,6 +747,16 @@ func Lex(words []string) ([]Token, error) {
 						state = 's'
 					}
 				} else {
+					call, err := lexCall(word)
+					if err != nil {
+						return nil, err
+					}
+					if call != nil {
+						ret = append(ret, *call)
+						snarf++
+						state = 'e'
+						continue
+					}
 					valid, string := validIdentifierStrP(word)
 					if valid {
 						if string {
@@ -336,8 +809,15 @@ func Lex(words []string) ([]Token, error) {
 					continue
 				}
 
+				call, err := lexCall(word)
+				if err != nil {
+					return nil, err
+				}
 				valid, string := validIdentifierStrP(word)
-				if valid {
+				if call != nil {
+					ret = append(ret, *call)
+					snarf++
+				} else if valid {
 					if string {
 						ret = append(ret, Token{Type: TokenIdentStr, StringData: word})
 					} else {
@@ -393,6 +873,8 @@ func Lex(words []string) ([]Token, error) {
 			} else {
 				return nil, fmt.Errorf("Cannot use integer variable as a prompt in INPUT")
 			}
+		} else if lw := len(words[1]); lw > 1 && words[1][0] == '"' && words[1][lw-1] == '"' {
+			ret = append(ret, Token{Type: TokenConstStr, StringData: words[1][1 : lw-1]})
 		} else if len(words[1]) > 0 && words[1][0] == '"' {
 			str := words[1][1:]
 			done := false
@@ -404,7 +886,7 @@ func Lex(words []string) ([]Token, error) {
 					break
 				}
 				wl := len(words[i])
-				if words[i][wl-1] == '"' {
+				if wl > 0 && words[i][wl-1] == '"' {
 					str += " " + words[i][:wl-1]
 					done = true
 					i++
@@ -434,11 +916,29 @@ func Lex(words []string) ([]Token, error) {
 			return nil, fmt.Errorf("Invalid identifier %s", words[i])
 		}
 	default:
+		if label := labelName(words[0]); label != "" && len(words) == 1 {
+			ret = append(ret, Token{Type: TokenLabel, StringData: label})
+			break
+		}
 		return nil, fmt.Errorf("Unknown keyword %s", strings.ToUpper(words[0]))
 	}
 	return ret, nil
 }
 
+// labelName ...
+// Returns the name of the label declared by a word such as "loop:", or ""
+// if the word isn't a label.
+func labelName(word string) string {
+	if !strings.HasSuffix(word, ":") {
+		return ""
+	}
+	valid, string := validIdentifierStrP(word[:len(word)-1])
+	if !valid || string {
+		return ""
+	}
+	return word[:len(word)-1]
+}
+
 func (t Token) String() string {
 	switch t.Type {
 	case TokenIf:
@@ -447,10 +947,110 @@ func (t Token) String() string {
 		return "LET"
 	case TokenPrint:
 		return "PRINT"
+	case TokenInput:
+		return "INPUT"
+	case TokenThen:
+		return "THEN"
+	case TokenElse:
+		return "ELSE"
+	case TokenFieldSep:
+		return ";"
+	case TokenEq:
+		return "="
+	case TokenNe:
+		return "!="
+	case TokenGt:
+		return ">"
+	case TokenLt:
+		return "<"
+	case TokenGtEq:
+		return ">="
+	case TokenLtEq:
+		return "<="
+	case TokenAdd:
+		return "+"
+	case TokenSub:
+		return "-"
+	case TokenMul:
+		return "*"
+	case TokenDiv:
+		return "/"
+	case TokenAnd:
+		return "&"
+	case TokenOr:
+		return "|"
+	case TokenXor:
+		return "^"
 	case TokenExit:
 		return "END"
-	case TokenGoto:
-		return fmt.Sprintf("GOTO %d", t.IntData)
+	case TokenSelect:
+		return "SELECT CASE"
+	case TokenCase:
+		return "CASE"
+	case TokenCaseElse:
+		return "CASE ELSE"
+	case TokenEndSelect:
+		return "END SELECT"
+	case TokenTo:
+		return "TO"
+	case TokenIs:
+		return "IS"
+	case TokenComma:
+		return ","
+	case TokenDef:
+		return "DEF " + t.StringData
+	case TokenSubroutine:
+		return "SUB " + t.StringData
+	case TokenFunction:
+		return "FUNCTION " + t.StringData
+	case TokenEndSub:
+		return "END SUB"
+	case TokenEndFunction:
+		return "END FUNCTION"
+	case TokenExitSub:
+		return "EXIT SUB"
+	case TokenExitFunction:
+		return "EXIT FUNCTION"
+	case TokenLocal:
+		return "LOCAL"
+	case TokenByRef:
+		return "BYREF"
+	case TokenCallSub:
+		return "CALL " + Token{Type: TokenCall, StringData: t.StringData, Args: t.Args}.String()
+	case TokenCall:
+		args := make([]string, len(t.Args))
+		for i, arg := range t.Args {
+			args[i] = tokensString(arg)
+		}
+		return fmt.Sprintf("%s(%s)", t.StringData, strings.Join(args, ", "))
+	case TokenGoto, TokenGosub:
+		kw := "GOTO"
+		if t.Type == TokenGosub {
+			kw = "GOSUB"
+		}
+		if t.StringData != "" {
+			return kw + " " + t.StringData
+		}
+		return fmt.Sprintf("%s %d", kw, t.IntData)
+	case TokenReturn:
+		return "RETURN"
+	case TokenStop:
+		return "STOP"
+	case TokenTron:
+		if t.StringData != "" {
+			return "TRON " + t.StringData
+		}
+		return "TRON"
+	case TokenTroff:
+		return "TROFF"
+	case TokenAssert:
+		return "ASSERT"
+	case TokenTest:
+		return fmt.Sprintf("TEST \"%s\"", t.StringData)
+	case TokenEndTest:
+		return "END TEST"
+	case TokenLabel:
+		return t.StringData + ":"
 	case TokenIdentStr:
 		return t.StringData
 	case TokenIdentInt:
@@ -463,3 +1063,11 @@ func (t Token) String() string {
 		return fmt.Sprintf("{type: %d, str: %s, int: %d}", t.Type, t.StringData, t.IntData)
 	}
 }
+
+func tokensString(l []Token) string {
+	words := make([]string, len(l))
+	for i, t := range l {
+		words[i] = t.String()
+	}
+	return strings.Join(words, " ")
+}
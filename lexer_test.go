@@ -0,0 +1,189 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func ident(name string) Token  { return Token{Type: TokenIdentInt, StringData: name} }
+func sident(name string) Token { return Token{Type: TokenIdentStr, StringData: name} }
+func num(i int) Token          { return Token{Type: TokenConstInt, IntData: i} }
+func str(s string) Token       { return Token{Type: TokenConstStr, StringData: s} }
+func tok(t TokenType) Token    { return Token{Type: t} }
+
+func call(name string, args ...[]Token) Token {
+	if args == nil {
+		args = [][]Token{}
+	}
+	return Token{Type: TokenCall, StringData: name, Args: args}
+}
+
+func TestLex(t *testing.T) {
+	tests := []struct {
+		line string
+		want []Token
+	}{
+		{`LET a = 1`, []Token{tok(TokenLet), ident("a"), tok(TokenEq), num(1)}},
+		{`let a = b + -2`, []Token{tok(TokenLet), ident("a"), tok(TokenEq), ident("b"), tok(TokenAdd), num(-2)}},
+		{`LET a + 1`, []Token{tok(TokenLet), ident("a"), tok(TokenAdd), num(1)}},
+		{`LET a = 6 / 3 * 2 - 1`, []Token{tok(TokenLet), ident("a"), tok(TokenEq), num(6), tok(TokenDiv), num(3),
+			tok(TokenMul), num(2), tok(TokenSub), num(1)}},
+		{`LET a = 1 & 2 | 3 ^ 4`, []Token{tok(TokenLet), ident("a"), tok(TokenEq), num(1), tok(TokenAnd), num(2),
+			tok(TokenOr), num(3), tok(TokenXor), num(4)}},
+		{`LET a = 1 ; s$ = "two  words"`, []Token{tok(TokenLet), ident("a"), tok(TokenEq), num(1), tok(TokenFieldSep),
+			sident("s$"), tok(TokenEq), str("two  words")}},
+		{`LET s$ = " "`, []Token{tok(TokenLet), sident("s$"), tok(TokenEq), str(" ")}},
+		{`LET a = f(b, 2)`, []Token{tok(TokenLet), ident("a"), tok(TokenEq), call("f", []Token{ident("b")}, []Token{num(2)})}},
+		{`PRINT "Hello, " n$ 1`, []Token{tok(TokenPrint), str("Hello, "), sident("n$"), num(1)}},
+		{`PRINT`, []Token{tok(TokenPrint)}},
+		{`INPUT "Name? " n$`, []Token{tok(TokenInput), str("Name? "), sident("n$")}},
+		{`INPUT "Name?" n$`, []Token{tok(TokenInput), str("Name?"), sident("n$")}},
+		{`INPUT p$ n`, []Token{tok(TokenInput), sident("p$"), ident("n")}},
+		{`IF a > 1 THEN PRINT a`, []Token{tok(TokenIf), ident("a"), tok(TokenGt), num(1), tok(TokenThen),
+			tok(TokenPrint), ident("a")}},
+		{`IF a$ != "x" THEN GOTO 10 ELSE END`, []Token{tok(TokenIf), sident("a$"), tok(TokenNe), str("x"),
+			tok(TokenThen), {Type: TokenGoto, IntData: 10}, tok(TokenElse), tok(TokenExit)}},
+		{`IF a <= 1 THEN LET b = 1 ELSE LET b = 2`, []Token{tok(TokenIf), ident("a"), tok(TokenLtEq), num(1),
+			tok(TokenThen), tok(TokenLet), ident("b"), tok(TokenEq), num(1), tok(TokenElse), tok(TokenLet), ident("b"),
+			tok(TokenEq), num(2)}},
+		{`GOTO 100`, []Token{{Type: TokenGoto, IntData: 100}}},
+		{`GOTO loop`, []Token{{Type: TokenGoto, StringData: "loop"}}},
+		{`GOSUB 20`, []Token{{Type: TokenGosub, IntData: 20}}},
+		{`RETURN`, []Token{tok(TokenReturn)}},
+		{`END`, []Token{tok(TokenExit)}},
+		{`EXIT`, []Token{tok(TokenExit)}},
+		{`STOP`, []Token{tok(TokenStop)}},
+		{`TRON`, []Token{tok(TokenTron)}},
+		{`TRON VARS`, []Token{{Type: TokenTron, StringData: "VARS"}}},
+		{`TROFF`, []Token{tok(TokenTroff)}},
+		{`loop:`, []Token{{Type: TokenLabel, StringData: "loop"}}},
+		{`SELECT CASE a + 1`, []Token{tok(TokenSelect), ident("a"), tok(TokenAdd), num(1)}},
+		{`CASE 1, 2`, []Token{tok(TokenCase), num(1), tok(TokenComma), num(2)}},
+		{`CASE IS >= 3`, []Token{tok(TokenCase), tok(TokenIs), tok(TokenGtEq), num(3)}},
+		{`CASE 1 TO 5`, []Token{tok(TokenCase), num(1), tok(TokenTo), num(5)}},
+		{`CASE "a, b"`, []Token{tok(TokenCase), str("a, b")}},
+		{`CASE ELSE`, []Token{tok(TokenCaseElse)}},
+		{`END SELECT`, []Token{tok(TokenEndSelect)}},
+		{`DEF fnsq(x) = x * x`, []Token{{Type: TokenDef, StringData: "fnsq"}, ident("x"), tok(TokenEq), ident("x"),
+			tok(TokenMul), ident("x")}},
+		{`DEF fnadd(a, b) = a + b`, []Token{{Type: TokenDef, StringData: "fnadd"}, ident("a"), tok(TokenComma), ident("b"),
+			tok(TokenEq), ident("a"), tok(TokenAdd), ident("b")}},
+		{`SUB greet`, []Token{{Type: TokenSubroutine, StringData: "greet"}}},
+		{`SUB swap(BYREF a, BYVAL b)`, []Token{{Type: TokenSubroutine, StringData: "swap"}, tok(TokenByRef), ident("a"),
+			tok(TokenComma), ident("b")}},
+		{`FUNCTION name$(n)`, []Token{{Type: TokenFunction, StringData: "name$"}, ident("n")}},
+		{`END SUB`, []Token{tok(TokenEndSub)}},
+		{`EXIT SUB`, []Token{tok(TokenExitSub)}},
+		{`END FUNCTION`, []Token{tok(TokenEndFunction)}},
+		{`EXIT FUNCTION`, []Token{tok(TokenExitFunction)}},
+		{`CALL greet`, []Token{{Type: TokenCallSub, StringData: "greet", Args: [][]Token{}}}},
+		{`CALL swap(a, b)`, []Token{{Type: TokenCallSub, StringData: "swap", Args: [][]Token{{ident("a")}, {ident("b")}}}}},
+		{`LOCAL a, s$`, []Token{tok(TokenLocal), ident("a"), tok(TokenComma), sident("s$")}},
+	}
+	for _, test := range tests {
+		line, err := MakeLine(test.line)
+		if err != nil {
+			t.Errorf("%s: %v", test.line, err)
+			continue
+		}
+		if !reflect.DeepEqual(line.Tokens, test.want) {
+			t.Errorf("%s:\n got %v\nwant %v", test.line, line.Tokens, test.want)
+		}
+	}
+}
+
+func TestLexErrors(t *testing.T) {
+	tests := []string{
+		`LET`,
+		`LET a`,
+		`LET 1 = a`,
+		`LET a = "unterminated`,
+		`LET a = 1 ;`,
+		`PRINT "unterminated`,
+		`INPUT n$`,
+		`INPUT p n`,
+		`INPUT "prompt n$`,
+		`IF a > 1`,
+		`IF a > 1 THEN`,
+		`IF a > 1 ELSE PRINT a THEN PRINT b`,
+		`IF THEN PRINT a`,
+		`IF a > 1 THEN ELSE PRINT a`,
+		`INPUT "  n`,
+		`GOTO`,
+		`GOTO s$`,
+		`GOTO -1`,
+		`GOTO 99999999`,
+		`RETURN 10`,
+		`STOP now`,
+		`TRON all`,
+		`SELECT a`,
+		`CASE`,
+		`CASE ELSE 1`,
+		`CASE IS 1`,
+		`CASE 1 TO`,
+		`DEF sq(x) = x`,
+		`DEF fnsq(x) =`,
+		`SUB`,
+		`SUB name$`,
+		`SUB f(1)`,
+		`CALL`,
+		`CALL f(`,
+		`LOCAL`,
+		`LOCAL 1`,
+		`FROB`,
+	}
+	for _, test := range tests {
+		if _, err := MakeLine(test); err == nil {
+			t.Errorf("%s: expected an error", test)
+		}
+	}
+}
+
+// TestFormatRoundTrip checks that every statement form formats to text which
+// lexes to the same tokens.
+func TestFormatRoundTrip(t *testing.T) {
+	for _, text := range []string{
+		`LET a = 1 ; s$ = "two  words" ; b + 1`,
+		`IF a$ != "x" THEN CALL f(a, g(b + 1)) ELSE LOCAL a, b$`,
+		`DEF fnadd(a, b) = a / b`,
+		`SUB swap(BYREF a, b)`,
+		`CASE IS > 1, 2 TO 3, "a"`,
+		`INPUT "Name? " n$`,
+		`TRON VARS`,
+		`CALL greet`,
+	} {
+		line, err := MakeLine(text)
+		if err != nil {
+			t.Fatalf("%s: %v", text, err)
+		}
+		formatted := formatTokens(line.Tokens)
+		again, err := MakeLine(formatted)
+		if err != nil {
+			t.Errorf("%s formatted as %s: %v", text, formatted, err)
+		} else if !reflect.DeepEqual(line.Tokens, again.Tokens) {
+			t.Errorf("%s formatted as %s, which lexes differently", text, formatted)
+		}
+	}
+}
+
+func FuzzMakeLine(f *testing.F) {
+	for _, seed := range []string{`LET a = 1 ; b$ = "x y"`, `IF a > 1 THEN PRINT "a" ELSE GOTO 10`,
+		`INPUT "p " a`, `CASE IS > 1, 2 TO 3`, `DEF fnf(a) = a`, `CALL f(g(1), "a, b")`, `SUB s(BYREF a)`} {
+		f.Add(seed)
+	}
+	f.Fuzz(func(t *testing.T, text string) {
+		line, err := MakeLine(text)
+		if _, ok := err.(panicError); ok {
+			t.Fatalf("%q: %v", text, err)
+		}
+		if err != nil || !line.Used {
+			return
+		}
+		// Whatever lexes must also survive formatting
+		if _, err := MakeLine(formatTokens(line.Tokens)); err != nil {
+			if _, ok := err.(panicError); ok {
+				t.Fatalf("%q formatted: %v", text, err)
+			}
+		}
+	})
+}
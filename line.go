@@ -1,20 +1,26 @@
 package main
 
 import (
+	"fmt"
 	"strings"
 )
 
 // Line ...
+// Source is the line of the file the line was loaded from, or 0 if it was
+// typed in.
 type Line struct {
 	Used    bool
 	Content string
 	Tokens  []Token
+	Source  int
 }
 
 // MakeLine ...
 // Parse line from a string. Returns an error if syntax is bad.
-func MakeLine(line string) (*Line, error) {
-	ret := &Line{Content: line}
+func MakeLine(line string) (ret *Line, err error) {
+	defer recoverError(&err)
+	line = strings.TrimSpace(line)
+	ret = &Line{Content: line}
 	if len(line) == 0 {
 		ret.Used = false
 		return ret, nil
@@ -29,3 +35,23 @@ func MakeLine(line string) (*Line, error) {
 
 	return ret, nil
 }
+
+// panicError ...
+// A panic in ez, caught by recoverError. It means there's a bug in ez, not
+// the program.
+type panicError struct {
+	value interface{}
+}
+
+func (e panicError) Error() string {
+	return fmt.Sprintf("Internal error: %v", e.value)
+}
+
+// recoverError ...
+// Deferred by functions which return an error, to turn a panic into an error
+// instead of crashing ez.
+func recoverError(err *error) {
+	if r := recover(); r != nil {
+		*err = panicError{r}
+	}
+}
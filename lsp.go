@@ -0,0 +1,613 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"unicode"
+	"unicode/utf16"
+	"unicode/utf8"
+)
+
+// lspMessage ...
+// A JSON-RPC request or notification from a client of the Language Server
+// Protocol. Notifications have no ID.
+type lspMessage struct {
+	ID     json.RawMessage `json:"id"`
+	Method string          `json:"method"`
+	Params json.RawMessage `json:"params"`
+}
+
+type lspPosition struct {
+	Line      int `json:"line"`
+	Character int `json:"character"`
+}
+
+type lspRange struct {
+	Start lspPosition `json:"start"`
+	End   lspPosition `json:"end"`
+}
+
+type lspLocation struct {
+	URI   string   `json:"uri"`
+	Range lspRange `json:"range"`
+}
+
+type lspTextEdit struct {
+	Range   lspRange `json:"range"`
+	NewText string   `json:"newText"`
+}
+
+// lspPositionParams ...
+// The parameters of the requests about a position in a document
+type lspPositionParams struct {
+	TextDocument struct {
+		URI string `json:"uri"`
+	} `json:"textDocument"`
+	Position lspPosition `json:"position"`
+	NewName  string      `json:"newName"`
+}
+
+// symbolKind ...
+// What a name or number in a document refers to
+type symbolKind int
+
+const (
+	symLine     symbolKind = iota // the number at the start of a line
+	symJump                       // a line number after GOTO or GOSUB
+	symLabel                      // a label declaration
+	symLabelRef                   // a label after GOTO or GOSUB
+	symVar                        // a variable
+	symProc                       // the name declared by SUB, FUNCTION or DEF
+	symCall                       // a call to a SUB, FUNCTION or DEF FN
+)
+
+// symbol ...
+// A name or line number in a document. line is the line of the document, and
+// start and end are byte offsets into it.
+type symbol struct {
+	kind  symbolKind
+	name  string
+	line  int
+	start int
+	end   int
+}
+
+// document ...
+// A program open in the editor. numbers gives the line of the document each
+// line number of the program is on. warnings are from checkProgram, and only
+// found when there are no errors.
+type document struct {
+	text     []string
+	symbols  []symbol
+	numbers  map[int]int
+	errs     []error
+	warnings []warning
+}
+
+// lspServer ...
+// A session of the Language Server Protocol
+type lspServer struct {
+	r        *bufio.Reader
+	w        io.Writer
+	docs     map[string]*document
+	shutdown bool
+}
+
+// parseDocument ...
+// Parses a program with the same rules as LOAD, and finds the symbols in it.
+func parseDocument(text string) *document {
+	doc := &document{text: strings.Split(text, "\n"), numbers: make(map[int]int)}
+	for i := range doc.text {
+		doc.text[i] = strings.TrimRight(doc.text[i], "\r")
+	}
+
+	parsed, errs := parseProgram(strings.NewReader(text))
+	doc.errs = errs
+	labelNames := make(map[string]bool)
+	for num, line := range parsed {
+		if line == nil {
+			continue
+		}
+		doc.numbers[num] = line.Source - 1
+		if line.Used && line.Tokens[0].Type == TokenLabel {
+			labelNames[line.Tokens[0].StringData] = true
+		}
+	}
+	for _, err := range errs {
+		if se, ok := err.(sourceError); ok {
+			if _, taken := doc.numbers[se.num]; !taken {
+				doc.numbers[se.num] = se.source - 1
+			}
+		}
+	}
+
+	for i, raw := range doc.text {
+		doc.symbols = append(doc.symbols, scanSymbols(i, raw, labelNames)...)
+	}
+	if len(errs) == 0 {
+		doc.warnings = checkProgram(parsed)
+	}
+	return doc
+}
+
+func isKeyword(word string) bool {
+	for _, kw := range keywords {
+		if kw == word {
+			return true
+		}
+	}
+	return false
+}
+
+// scanSymbols ...
+// Finds the line numbers, labels and names in line i of a document, skipping
+// string constants and keywords.
+func scanSymbols(i int, raw string, labelNames map[string]bool) []symbol {
+	syms := []symbol{}
+	prev := ""
+	atom := 0
+	content := 0
+	quoted := false
+
+	for j := 0; j < len(raw); {
+		ru, size := utf8.DecodeRuneInString(raw[j:])
+		switch {
+		case ru == '"':
+			quoted = !quoted
+			prev = ""
+			atom++
+			j += size
+		case quoted:
+			j += size
+		case '0' <= ru && ru <= '9':
+			k := j
+			for k < len(raw) && '0' <= raw[k] && raw[k] <= '9' {
+				k++
+			}
+			num, _ := strconv.Atoi(raw[j:k])
+			if atom == 0 {
+				syms = append(syms, symbol{symLine, strconv.Itoa(num), i, j, k})
+				content = 1
+			} else if prev == "GOTO" || prev == "GOSUB" {
+				syms = append(syms, symbol{symJump, strconv.Itoa(num), i, j, k})
+			}
+			prev = ""
+			atom++
+			j = k
+		case unicode.IsLetter(ru) && ru <= 0xEF:
+			k := j
+			for k < len(raw) {
+				r, s := utf8.DecodeRuneInString(raw[k:])
+				if !unicode.IsLetter(r) || r > 0xEF {
+					break
+				}
+				k += s
+			}
+			if k < len(raw) && raw[k] == '$' {
+				k++
+			}
+			word := raw[j:k]
+			upper := strings.ToUpper(word)
+			next := byte(0)
+			if k < len(raw) {
+				next = raw[k]
+			}
+
+			kind := symVar
+			switch {
+			case atom == content && upper == "REM":
+				return syms
+			case atom == content && next == ':':
+				kind = symLabel
+			case isKeyword(upper):
+				prev = upper
+				atom++
+				j = k
+				continue
+			case prev == "GOTO" || prev == "GOSUB":
+				if labelNames[word] {
+					kind = symLabelRef
+				}
+			case prev == "SUB" || prev == "FUNCTION" || prev == "DEF":
+				kind = symProc
+			case prev == "CALL" || next == '(':
+				kind = symCall
+			case prev == "TRON" && upper == "VARS":
+				kind = -1
+			}
+			if kind >= 0 {
+				syms = append(syms, symbol{kind, word, i, j, k})
+			}
+			prev = ""
+			atom++
+			j = k
+		default:
+			if ru != ' ' {
+				prev = ""
+				atom++
+			}
+			j += size
+		}
+	}
+	return syms
+}
+
+// utf16Column ...
+// Converts a byte offset into a line to the column the client uses, which
+// counts UTF-16 code units.
+func utf16Column(raw string, offset int) int {
+	return len(utf16.Encode([]rune(raw[:offset])))
+}
+
+// byteOffset ...
+// Converts a column from the client to a byte offset into a line.
+func byteOffset(raw string, column int) int {
+	units := 0
+	for offset, ru := range raw {
+		if units >= column {
+			return offset
+		}
+		units += len(utf16.Encode([]rune{ru}))
+	}
+	return len(raw)
+}
+
+func (doc *document) location(uri string, s symbol) lspLocation {
+	raw := doc.text[s.line]
+	return lspLocation{uri, lspRange{
+		lspPosition{s.line, utf16Column(raw, s.start)},
+		lspPosition{s.line, utf16Column(raw, s.end)},
+	}}
+}
+
+// symbolAt ...
+// Returns the symbol under a position, or nil.
+func (doc *document) symbolAt(pos lspPosition) *symbol {
+	if pos.Line < 0 || pos.Line >= len(doc.text) {
+		return nil
+	}
+	offset := byteOffset(doc.text[pos.Line], pos.Character)
+	for i, s := range doc.symbols {
+		if s.line == pos.Line && s.start <= offset && offset <= s.end {
+			return &doc.symbols[i]
+		}
+	}
+	return nil
+}
+
+// lineSymbol ...
+// Returns the line number at the start of program line num, or an empty
+// symbol at the start of its line of the document if it was numbered
+// automatically.
+func (doc *document) lineSymbol(num int) (symbol, bool) {
+	line, ok := doc.numbers[num]
+	if !ok {
+		return symbol{}, false
+	}
+	for _, s := range doc.symbols {
+		if s.line == line && s.kind == symLine {
+			return s, true
+		}
+	}
+	return symbol{symLine, strconv.Itoa(num), line, 0, 0}, true
+}
+
+// related ...
+// Returns the symbols which refer to the same thing as s: the declaration
+// first, if there is one, then the uses.
+func (doc *document) related(s *symbol) []symbol {
+	ret := []symbol{}
+	switch s.kind {
+	case symLine, symJump:
+		num, _ := strconv.Atoi(s.name)
+		if decl, ok := doc.lineSymbol(num); ok {
+			ret = append(ret, decl)
+		}
+		for _, other := range doc.symbols {
+			if other.kind == symJump && other.name == s.name {
+				ret = append(ret, other)
+			}
+		}
+		return ret
+	}
+
+	kinds := map[symbolKind][]symbolKind{
+		symLabel:    {symLabel, symLabelRef},
+		symLabelRef: {symLabel, symLabelRef},
+		symProc:     {symProc, symCall},
+		symCall:     {symProc, symCall},
+		symVar:      {symVar},
+	}[s.kind]
+	for _, kind := range kinds {
+		for _, other := range doc.symbols {
+			if other.kind == kind && other.name == s.name {
+				ret = append(ret, other)
+			}
+		}
+	}
+	return ret
+}
+
+// diagnostics ...
+// Returns the errors and warnings in the document, as the client wants them.
+func (doc *document) diagnostics() []interface{} {
+	ret := []interface{}{}
+	add := func(line, severity int, message string) {
+		end := 0
+		if line < len(doc.text) {
+			end = utf16Column(doc.text[line], len(doc.text[line]))
+		}
+		ret = append(ret, map[string]interface{}{
+			"range":    lspRange{lspPosition{line, 0}, lspPosition{line, end}},
+			"severity": severity,
+			"source":   "ez",
+			"message":  message,
+		})
+	}
+	for _, err := range doc.errs {
+		line := 0
+		if se, ok := err.(sourceError); ok {
+			line = se.source - 1
+		}
+		add(line, 1, err.Error())
+	}
+	for _, w := range doc.warnings {
+		add(doc.numbers[w.index], 2, w.message)
+	}
+	return ret
+}
+
+func (l *lspServer) send(msg map[string]interface{}) {
+	msg["jsonrpc"] = "2.0"
+	body, err := json.Marshal(msg)
+	if err != nil {
+		return
+	}
+	writeMessage(l.w, body)
+}
+
+func (l *lspServer) reply(msg *lspMessage, result interface{}) {
+	l.send(map[string]interface{}{"id": msg.ID, "result": result})
+}
+
+func (l *lspServer) replyError(msg *lspMessage, code int, message string) {
+	l.send(map[string]interface{}{"id": msg.ID, "error": map[string]interface{}{"code": code, "message": message}})
+}
+
+func (l *lspServer) notify(method string, params interface{}) {
+	l.send(map[string]interface{}{"method": method, "params": params})
+}
+
+// update ...
+// Reparses a document after it's opened or edited, and sends its errors.
+func (l *lspServer) update(uri, text string) {
+	doc := parseDocument(text)
+	l.docs[uri] = doc
+	l.notify("textDocument/publishDiagnostics", map[string]interface{}{"uri": uri, "diagnostics": doc.diagnostics()})
+}
+
+// serve ...
+// Handles messages until the client sends exit. Returns the exit code.
+func (l *lspServer) serve() int {
+	for {
+		body, err := readMessage(l.r)
+		if err != nil {
+			if err != io.EOF {
+				fmt.Fprintln(os.Stderr, err.Error())
+			}
+			return 1
+		}
+		msg := &lspMessage{}
+		if err := json.Unmarshal(body, msg); err != nil {
+			fmt.Fprintln(os.Stderr, err.Error())
+			continue
+		}
+		if msg.Method == "exit" {
+			if l.shutdown {
+				return 0
+			}
+			return 1
+		}
+		l.handle(msg)
+	}
+}
+
+func (l *lspServer) handle(msg *lspMessage) {
+	switch msg.Method {
+	case "initialize":
+		l.reply(msg, map[string]interface{}{
+			"capabilities": map[string]interface{}{
+				"textDocumentSync":   1,
+				"definitionProvider": true,
+				"referencesProvider": true,
+				"hoverProvider":      true,
+				"renameProvider":     true,
+				"completionProvider": map[string]interface{}{},
+			},
+			"serverInfo": map[string]interface{}{"name": "ez"},
+		})
+	case "shutdown":
+		l.shutdown = true
+		l.reply(msg, nil)
+	case "textDocument/didOpen":
+		params := struct {
+			TextDocument struct {
+				URI  string `json:"uri"`
+				Text string `json:"text"`
+			} `json:"textDocument"`
+		}{}
+		json.Unmarshal(msg.Params, &params)
+		l.update(params.TextDocument.URI, params.TextDocument.Text)
+	case "textDocument/didChange":
+		params := struct {
+			TextDocument struct {
+				URI string `json:"uri"`
+			} `json:"textDocument"`
+			ContentChanges []struct {
+				Text string `json:"text"`
+			} `json:"contentChanges"`
+		}{}
+		json.Unmarshal(msg.Params, &params)
+		if n := len(params.ContentChanges); n > 0 {
+			l.update(params.TextDocument.URI, params.ContentChanges[n-1].Text)
+		}
+	case "textDocument/didClose":
+		params := lspPositionParams{}
+		json.Unmarshal(msg.Params, &params)
+		delete(l.docs, params.TextDocument.URI)
+		l.notify("textDocument/publishDiagnostics", map[string]interface{}{"uri": params.TextDocument.URI,
+			"diagnostics": []interface{}{}})
+	case "textDocument/definition", "textDocument/references", "textDocument/hover", "textDocument/rename":
+		params := lspPositionParams{}
+		json.Unmarshal(msg.Params, &params)
+		doc, ok := l.docs[params.TextDocument.URI]
+		if !ok {
+			l.replyError(msg, -32602, "Unknown document")
+			return
+		}
+		s := doc.symbolAt(params.Position)
+		if s == nil {
+			l.reply(msg, nil)
+			return
+		}
+		switch msg.Method {
+		case "textDocument/definition":
+			l.definition(msg, params.TextDocument.URI, doc, s)
+		case "textDocument/references":
+			locations := []lspLocation{}
+			for _, other := range doc.related(s) {
+				locations = append(locations, doc.location(params.TextDocument.URI, other))
+			}
+			l.reply(msg, locations)
+		case "textDocument/hover":
+			l.hover(msg, doc, s)
+		case "textDocument/rename":
+			l.rename(msg, params.TextDocument.URI, doc, s, params.NewName)
+		}
+	case "textDocument/completion":
+		params := lspPositionParams{}
+		json.Unmarshal(msg.Params, &params)
+		l.completion(msg, l.docs[params.TextDocument.URI])
+	default:
+		if msg.ID != nil {
+			l.replyError(msg, -32601, fmt.Sprintf("Unsupported method %s", msg.Method))
+		}
+	}
+}
+
+func (l *lspServer) definition(msg *lspMessage, uri string, doc *document, s *symbol) {
+	related := doc.related(s)
+	if len(related) == 0 {
+		l.reply(msg, nil)
+		return
+	}
+	decl := related[0]
+	if (s.kind == symJump || s.kind == symLine) && decl.kind != symLine {
+		// GOTO a line that doesn't exist
+		l.reply(msg, nil)
+		return
+	}
+	if (s.kind == symLabelRef && decl.kind != symLabel) || (s.kind == symCall && decl.kind != symProc) {
+		l.reply(msg, nil)
+		return
+	}
+	l.reply(msg, doc.location(uri, decl))
+}
+
+func (l *lspServer) hover(msg *lspMessage, doc *document, s *symbol) {
+	text := ""
+	switch s.kind {
+	case symVar:
+		if strings.HasSuffix(s.name, "$") {
+			text = fmt.Sprintf("`%s`: string variable", s.name)
+		} else {
+			text = fmt.Sprintf("`%s`: integer variable", s.name)
+		}
+	default:
+		if related := doc.related(s); len(related) > 0 && related[0].kind != symJump &&
+			related[0].kind != symLabelRef && related[0].kind != symCall {
+			text = "```\n" + doc.text[related[0].line] + "\n```"
+		}
+	}
+	if text == "" {
+		l.reply(msg, nil)
+		return
+	}
+	l.reply(msg, map[string]interface{}{
+		"contents": map[string]interface{}{"kind": "markdown", "value": text},
+		"range":    doc.location("", *s).Range,
+	})
+}
+
+// rename ...
+// Renames a variable everywhere in the document. Variables are global unless
+// declared LOCAL, so all of the uses of the name are renamed together, and it
+// can't be renamed to a variable that's already used, which would merge them.
+func (l *lspServer) rename(msg *lspMessage, uri string, doc *document, s *symbol, newName string) {
+	if s.kind != symVar {
+		l.replyError(msg, -32602, "Only variables can be renamed")
+		return
+	}
+	valid, stringp := validIdentifierStrP(newName)
+	if !valid || isKeyword(strings.ToUpper(newName)) {
+		l.replyError(msg, -32602, fmt.Sprintf("Invalid identifier %s", newName))
+		return
+	}
+	if stringp != strings.HasSuffix(s.name, "$") {
+		l.replyError(msg, -32602, "String variables end in $, and integer variables don't")
+		return
+	}
+	for _, other := range doc.symbols {
+		if other.kind == symVar && other.name == newName && newName != s.name {
+			l.replyError(msg, -32602, fmt.Sprintf("There's already a variable called %s", newName))
+			return
+		}
+	}
+
+	edits := []lspTextEdit{}
+	for _, other := range doc.related(s) {
+		edits = append(edits, lspTextEdit{doc.location(uri, other).Range, newName})
+	}
+	l.reply(msg, map[string]interface{}{"changes": map[string]interface{}{uri: edits}})
+}
+
+// completion ...
+// Offers the keywords, and the variables and procedures in the document.
+func (l *lspServer) completion(msg *lspMessage, doc *document) {
+	items := []interface{}{}
+	for _, kw := range keywords {
+		items = append(items, map[string]interface{}{"label": kw, "kind": 14})
+	}
+	if doc != nil {
+		seen := make(map[string]bool)
+		names := []symbol{}
+		for _, s := range doc.symbols {
+			if (s.kind == symVar || s.kind == symProc) && !seen[s.name] {
+				seen[s.name] = true
+				names = append(names, s)
+			}
+		}
+		sort.Slice(names, func(i, j int) bool { return names[i].name < names[j].name })
+		for _, s := range names {
+			kind := 6
+			if s.kind == symProc {
+				kind = 3
+			}
+			items = append(items, map[string]interface{}{"label": s.name, "kind": kind})
+		}
+	}
+	l.reply(msg, items)
+}
+
+// lspCommand ...
+// ez lsp serves the Language Server Protocol on standard input and output.
+func lspCommand() {
+	l := &lspServer{r: bufio.NewReader(os.Stdin), w: os.Stdout, docs: make(map[string]*document)}
+	os.Exit(l.serve())
+}
@@ -0,0 +1,138 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"testing"
+)
+
+// lspScript ...
+// Runs a session of the Language Server Protocol with the messages in
+// script, followed by shutdown and exit, and returns the responses by ID and
+// the notifications in order.
+func lspScript(t *testing.T, script []map[string]interface{}) (map[float64]map[string]interface{}, []map[string]interface{}) {
+	t.Helper()
+	var in bytes.Buffer
+	script = append(script, map[string]interface{}{"id": 1000, "method": "shutdown"},
+		map[string]interface{}{"method": "exit"})
+	for _, msg := range script {
+		msg["jsonrpc"] = "2.0"
+		body, _ := json.Marshal(msg)
+		writeMessage(&in, body)
+	}
+
+	var out bytes.Buffer
+	l := &lspServer{r: bufio.NewReader(&in), w: &out, docs: make(map[string]*document)}
+	if code := l.serve(); code != 0 {
+		t.Fatalf("exited with %d, want 0", code)
+	}
+
+	responses := make(map[float64]map[string]interface{})
+	notifications := []map[string]interface{}{}
+	r := bufio.NewReader(&out)
+	for {
+		body, err := readMessage(r)
+		if err != nil {
+			break
+		}
+		msg := map[string]interface{}{}
+		if err := json.Unmarshal(body, &msg); err != nil {
+			t.Fatal(err)
+		}
+		if id, ok := msg["id"].(float64); ok {
+			responses[id] = msg
+		} else {
+			notifications = append(notifications, msg)
+		}
+	}
+	return responses, notifications
+}
+
+// position ...
+// The parameters of a request about a position in the document test.bas
+func position(line, character int, extra ...string) map[string]interface{} {
+	params := map[string]interface{}{
+		"textDocument": map[string]interface{}{"uri": "file:///test.bas"},
+		"position":     map[string]interface{}{"line": line, "character": character},
+	}
+	for i := 0; i+1 < len(extra); i += 2 {
+		params[extra[i]] = extra[i+1]
+	}
+	return params
+}
+
+// ranges ...
+// Returns the locations or edits in a result as "line:start-end".
+func ranges(result interface{}) []string {
+	ret := []string{}
+	items, ok := result.([]interface{})
+	if !ok {
+		items = []interface{}{result}
+	}
+	for _, item := range items {
+		r := item.(map[string]interface{})["range"].(map[string]interface{})
+		start := r["start"].(map[string]interface{})
+		end := r["end"].(map[string]interface{})
+		ret = append(ret, fmt.Sprintf("%v:%v-%v", start["line"], start["character"], end["character"]))
+	}
+	return ret
+}
+
+func TestLSPSession(t *testing.T) {
+	broken := "10 LET n = 1\n20 PRINT n +\n"
+	fixed := "10 LET n = 1\n20 PRINT n\n30 GOTO 60\n40 LET m = 2\n50 PRINT m\n60 GOTO 40\n"
+	responses, notifications := lspScript(t, []map[string]interface{}{
+		{"id": 1, "method": "initialize", "params": map[string]interface{}{}},
+		{"method": "textDocument/didOpen", "params": map[string]interface{}{
+			"textDocument": map[string]interface{}{"uri": "file:///test.bas", "text": broken}}},
+		{"method": "textDocument/didChange", "params": map[string]interface{}{
+			"textDocument":   map[string]interface{}{"uri": "file:///test.bas"},
+			"contentChanges": []interface{}{map[string]interface{}{"text": fixed}}}},
+		{"id": 2, "method": "textDocument/definition", "params": position(2, 9)},
+		{"id": 3, "method": "textDocument/references", "params": position(0, 7)},
+		{"id": 4, "method": "textDocument/hover", "params": position(1, 9)},
+		{"id": 5, "method": "textDocument/rename", "params": position(0, 7, "newName", "count")},
+		{"id": 6, "method": "textDocument/rename", "params": position(0, 7, "newName", "m")},
+	})
+
+	if len(notifications) != 2 {
+		t.Fatalf("got %d notifications, want 2", len(notifications))
+	}
+	diagnostics := func(i int) []interface{} {
+		return notifications[i]["params"].(map[string]interface{})["diagnostics"].([]interface{})
+	}
+	if got := ranges(diagnostics(0)); !reflect.DeepEqual(got, []string{"1:0-12"}) {
+		t.Errorf("didOpen diagnostics at %v, want [1:0-12]", got)
+	}
+	if got := diagnostics(1); len(got) != 0 {
+		t.Errorf("didChange diagnostics got %v, want none", got)
+	}
+
+	if got := ranges(responses[2]["result"]); !reflect.DeepEqual(got, []string{"5:0-2"}) {
+		t.Errorf("definition of GOTO 60 got %v, want [5:0-2]", got)
+	}
+	if got := ranges(responses[3]["result"]); !reflect.DeepEqual(got, []string{"0:7-8", "1:9-10"}) {
+		t.Errorf("references to n got %v, want [0:7-8 1:9-10]", got)
+	}
+	hover := responses[4]["result"].(map[string]interface{})["contents"].(map[string]interface{})["value"]
+	if hover != "`n`: integer variable" {
+		t.Errorf("hover got %q", hover)
+	}
+
+	changes := responses[5]["result"].(map[string]interface{})["changes"].(map[string]interface{})
+	edits := changes["file:///test.bas"].([]interface{})
+	if got := ranges(edits); !reflect.DeepEqual(got, []string{"0:7-8", "1:9-10"}) {
+		t.Errorf("rename edits got %v, want [0:7-8 1:9-10]", got)
+	}
+	for _, e := range edits {
+		if text := e.(map[string]interface{})["newText"]; text != "count" {
+			t.Errorf("rename to count got %v", text)
+		}
+	}
+	if _, ok := responses[6]["error"]; !ok {
+		t.Errorf("renaming n to m, which is already a variable, got %v, want an error", responses[6])
+	}
+}
@@ -1,11 +1,12 @@
 package main
 
 import (
-	"bufio"
+	"bytes"
+	"flag"
 	"fmt"
 	"io"
+	"io/ioutil"
 	"os"
-	"strconv"
 	"strings"
 )
 
@@ -17,22 +18,24 @@ var stringVars = make(map[string]string)
 var intVars = make(map[string]int)
 var lines []*Line = make([]*Line, MaxLines)
 
-func listLines() {
-	for i, line := range lines {
-		if line != nil && line.Used {
-			fmt.Printf("%d %s\n", i, line.Content)
+// output is where the program prints to
+var output io.Writer = os.Stdout
+
+func listLines(w io.Writer, from, to int) error {
+	for i := from; i <= to && i < len(lines); i++ {
+		if lines[i] != nil && lines[i].Used {
+			if _, err := fmt.Fprintf(w, "%d %s\n", i, lines[i].Content); err != nil {
+				return err
+			}
 		}
 	}
+	return nil
 }
 
 func listLinesDebug() {
 	for i, line := range lines {
 		if line != nil && line.Used {
-			fmt.Printf("%d:", i)
-			for _, t := range line.Tokens {
-				fmt.Print(t.String())
-			}
-			fmt.Println()
+			fmt.Printf("%d: %s\n", i, tokensString(line.Tokens))
 		}
 	}
 }
@@ -42,114 +45,235 @@ func predicateTrue(l []Token) (bool, error) {
 		return false, fmt.Errorf("Predicate too small")
 	}
 
-	lint, rint := false, false
-	intl, intr := 0, 0
-	strl, strr := "", ""
+	opPos := -1
+	for i, token := range l {
+		if isComparisonType(token.Type) {
+			opPos = i
+			break
+		}
+	}
+	if opPos == -1 {
+		return false, fmt.Errorf("Not a comparison operator: %s", l[1].String())
+	}
 
-	switch l[0].Type {
-	case TokenConstInt:
-		intl = l[0].IntData
-		lint = true
-	case TokenConstStr:
-		strl = l[0].StringData
-		lint = false
-	case TokenIdentInt:
-		intl = intVars[l[0].StringData]
-		lint = true
-	case TokenIdentStr:
-		strl = stringVars[l[0].StringData]
-		lint = false
-	default:
+	if !isOperandType(l[0].Type) {
 		return false, fmt.Errorf("Unexpected token on left hand side of IF statement %s", l[0].String())
 	}
+	left, err := evalExpr(l[:opPos])
+	if err != nil {
+		return false, err
+	}
 
-	switch l[2].Type {
-	case TokenConstInt:
-		intr = l[2].IntData
-		rint = true
-	case TokenConstStr:
-		strr = l[2].StringData
-		rint = false
-	case TokenIdentInt:
-		intr = intVars[l[2].StringData]
-		rint = true
-	case TokenIdentStr:
-		strr = stringVars[l[2].StringData]
-		rint = false
-	default:
-		return false, fmt.Errorf("Unexpected token on right hand side of IF statement %s", l[2].String())
+	if opPos == len(l)-1 || !isOperandType(l[opPos+1].Type) {
+		return false, fmt.Errorf("Unexpected token on right hand side of IF statement %s", l[len(l)-1].String())
+	}
+	right, err := evalExpr(l[opPos+1:])
+	if err != nil {
+		return false, err
 	}
 
-	switch l[1].Type {
-	case TokenEq:
-		if lint && rint {
-			return intl == intr, nil
-		} else if !lint && !rint {
-			return strl == strr, nil
-		} else if lint && !rint {
-			return intl == len(strr), nil
-		} else {
-			return len(strl) == intr, nil
-		}
-	case TokenNe:
-		if lint && rint {
-			return intl != intr, nil
-		} else if !lint && !rint {
-			return strl != strr, nil
-		} else if lint && !rint {
-			return intl != len(strr), nil
-		} else {
-			return len(strl) != intr, nil
-		}
-	case TokenGt:
-		if lint && rint {
-			return intl > intr, nil
-		} else if !lint && !rint {
-			return strl > strr, nil
-		} else if lint && !rint {
-			return intl > len(strr), nil
-		} else {
-			return len(strl) > intr, nil
-		}
-	case TokenLt:
-		if lint && rint {
-			return intl < intr, nil
-		} else if !lint && !rint {
-			return strl < strr, nil
-		} else if lint && !rint {
-			return intl < len(strr), nil
-		} else {
-			return len(strl) < intr, nil
-		}
-	case TokenGtEq:
-		if lint && rint {
-			return intl >= intr, nil
-		} else if !lint && !rint {
-			return strl >= strr, nil
-		} else if lint && !rint {
-			return intl >= len(strr), nil
-		} else {
-			return len(strl) >= intr, nil
-		}
-	case TokenLtEq:
-		if lint && rint {
-			return intl <= intr, nil
-		} else if !lint && !rint {
-			return strl <= strr, nil
-		} else if lint && !rint {
-			return intl <= len(strr), nil
+	return compareValues(left, l[opPos], right)
+}
+
+// assign ...
+// Performs a single assignment from a LET statement, e.g. a = b + 1 or a + 1
+func assign(l []Token) error {
+	if len(l) == 1 {
+		return nil
+	}
+
+	var v value
+	var err error
+	if l[1].Type == TokenEq {
+		v, err = evalExpr(l[2:])
+	} else {
+		v, err = evalExpr(l)
+	}
+	if err != nil {
+		return err
+	}
+	return setVar(l[0], v)
+}
+
+// assert ...
+// Checks the condition of an ASSERT statement, and fails with its message, or
+// the condition itself if there isn't one, when it's false.
+func assert(l []Token) error {
+	end := len(l)
+	for i, token := range l {
+		if token.Type == TokenComma {
+			end = i
+			break
+		}
+	}
+	ok, err := predicateTrue(l[1:end])
+	if err != nil || ok {
+		return err
+	}
+
+	message := joinTokens(l[1:end])
+	if end < len(l) {
+		v, err := evalExpr(l[end+1:])
+		if err != nil {
+			return err
+		}
+		message = v.String()
+	}
+	if currentLine < 0 {
+		return fmt.Errorf("ASSERT failed: %s", message)
+	}
+	return fmt.Errorf("%d: ASSERT failed: %s", currentLine, message)
+}
+
+// caseMatches ...
+// Checks the value of a SELECT CASE against the clauses of a CASE statement.
+func caseMatches(v value, l []Token) (bool, error) {
+	if l[0].Type == TokenCaseElse {
+		return true, nil
+	}
+
+	start := 1
+	for i := 1; i <= len(l); i++ {
+		if i < len(l) && l[i].Type != TokenComma {
+			continue
+		}
+		clause := l[start:i]
+		start = i + 1
+
+		if len(clause) == 0 {
+			return false, errInvalidCase
+		}
+
+		match := false
+		if clause[0].Type == TokenIs {
+			if len(clause) < 3 {
+				return false, errInvalidCase
+			}
+			r, err := evalExpr(clause[2:])
+			if err != nil {
+				return false, err
+			}
+			match, err = compareValues(v, clause[1], r)
+			if err != nil {
+				return false, err
+			}
 		} else {
-			return len(strl) <= intr, nil
+			toPos := -1
+			for j, token := range clause {
+				if token.Type == TokenTo {
+					toPos = j
+				}
+			}
+
+			if toPos == -1 {
+				r, err := evalExpr(clause)
+				if err != nil {
+					return false, err
+				}
+				match, _ = compareValues(v, Token{Type: TokenEq}, r)
+			} else {
+				lo, err := evalExpr(clause[:toPos])
+				if err != nil {
+					return false, err
+				}
+				hi, err := evalExpr(clause[toPos+1:])
+				if err != nil {
+					return false, err
+				}
+				above, _ := compareValues(v, Token{Type: TokenGtEq}, lo)
+				below, _ := compareValues(v, Token{Type: TokenLtEq}, hi)
+				match = above && below
+			}
+		}
+
+		if match {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// selectCase ...
+// Evaluates the SELECT CASE on line index, returning the index of the first
+// matching CASE or of the END SELECT if nothing matched.
+func selectCase(lines []*Line, index int) (int, error) {
+	v, err := evalExpr(lines[index].Tokens[1:])
+	if err != nil {
+		return 0, err
+	}
+
+	depth := 0
+	for i := index + 1; i < len(lines); i++ {
+		if lines[i] == nil || !lines[i].Used {
+			continue
+		}
+		switch lines[i].Tokens[0].Type {
+		case TokenSelect:
+			depth++
+		case TokenEndSelect:
+			if depth == 0 {
+				return i, nil
+			}
+			depth--
+		case TokenCase, TokenCaseElse:
+			if depth == 0 {
+				match, err := caseMatches(v, lines[i].Tokens)
+				if err != nil {
+					return 0, err
+				}
+				if match {
+					return i, nil
+				}
+			}
 		}
-	default:
-		return false, fmt.Errorf("Not a comparison operator: %s", l[1].String())
 	}
+	return 0, fmt.Errorf("SELECT CASE without END SELECT")
+}
+
+// endSelect ...
+// Returns the index of the END SELECT closing the CASE on line index.
+func endSelect(lines []*Line, index int) (int, error) {
+	depth := 0
+	for i := index + 1; i < len(lines); i++ {
+		if lines[i] == nil || !lines[i].Used {
+			continue
+		}
+		switch lines[i].Tokens[0].Type {
+		case TokenSelect:
+			depth++
+		case TokenEndSelect:
+			if depth == 0 {
+				return i, nil
+			}
+			depth--
+		}
+	}
+	return 0, fmt.Errorf("CASE without END SELECT")
 }
 
 func execTokenList(l []Token) ([]Token, error) {
 	switch l[0].Type {
-	case TokenExit, TokenGoto:
+	case TokenLabel:
+	case TokenExit, TokenGoto, TokenGosub, TokenReturn, TokenStop, TokenCallSub, TokenEndSub, TokenExitSub, TokenEndFunction, TokenExitFunction,
+		TokenEndTest:
 		return l, nil
+	case TokenSelect, TokenCase, TokenCaseElse, TokenEndSelect, TokenSubroutine, TokenFunction, TokenTest:
+		return nil, fmt.Errorf("%s can only be used in a program", l[0].String())
+	case TokenTron:
+		tracing = true
+		traceVars = l[0].StringData != ""
+	case TokenTroff:
+		tracing = false
+		traceVars = false
+	case TokenLocal:
+		for _, token := range l[1:] {
+			if token.Type == TokenComma {
+				continue
+			}
+			if err := declareLocal(token); err != nil {
+				return nil, err
+			}
+		}
 	case TokenIf:
 		thenPos := -1
 		elsePos := -1
@@ -165,6 +289,7 @@ func execTokenList(l []Token) ([]Token, error) {
 		if err != nil {
 			return nil, err
 		}
+		coverBranch(pred)
 
 		if pred {
 			if elsePos == -1 {
@@ -175,275 +300,332 @@ func execTokenList(l []Token) ([]Token, error) {
 			return execTokenList(l[elsePos+1:])
 		}
 	case TokenInput:
+		if len(l) != 3 {
+			return nil, errInvalidInput
+		}
 		prompt := ""
 		if l[1].Type == TokenConstStr {
 			prompt = l[1].StringData
 		} else if l[1].Type == TokenIdentStr {
-			prompt = stringVars[l[1].StringData]
+			prompt = getStr(l[1].StringData)
 		} else {
 			return nil, fmt.Errorf("Unexpected token %s in INPUT statement", l[1].String())
 		}
 
 		if l[2].Type == TokenIdentInt {
-			var err error
-			intVars[l[2].StringData], err = InputNumber(prompt)
+			num, err := InputNumber(prompt)
 			if err != nil {
 				return nil, err
 			}
+			setInt(l[2].StringData, num)
 		} else if l[2].Type == TokenIdentStr {
-			var err error
-			stringVars[l[2].StringData], err = InputString(prompt)
+			str, err := InputString(prompt)
 			if err != nil {
 				return nil, err
 			}
+			setStr(l[2].StringData, str)
 		} else {
 			return nil, fmt.Errorf("Unexpected token %s in INPUT statement", l[2].String())
 		}
 	case TokenLet:
-		ident := ""
-		identi := false
-		mode := 'R' // replace
-		for i := 1; i < len(l); i++ {
-			if ident == "" {
-				if l[i].Type == TokenIdentInt || l[i].Type == TokenIdentStr {
-					ident = l[i].StringData
-					identi = l[i].Type == TokenIdentInt
-				} else {
-					return nil, fmt.Errorf("Not an identifier: %s", l[i].String())
-				}
-			} else if identi && (l[i].Type == TokenIdentInt || l[i].Type == TokenConstInt) {
-				switch mode {
-				case 'R':
-					if l[i].Type == TokenIdentInt {
-						intVars[ident] = intVars[l[i].StringData]
-					} else {
-						intVars[ident] = l[i].IntData
-					}
-				case '+':
-					if l[i].Type == TokenIdentInt {
-						intVars[ident] += intVars[l[i].StringData]
-					} else {
-						intVars[ident] += l[i].IntData
-					}
-				case '-':
-					if l[i].Type == TokenIdentInt {
-						intVars[ident] -= intVars[l[i].StringData]
-					} else {
-						intVars[ident] -= l[i].IntData
-					}
-				case '*':
-					if l[i].Type == TokenIdentInt {
-						intVars[ident] *= intVars[l[i].StringData]
-					} else {
-						intVars[ident] *= l[i].IntData
-					}
-				case '/':
-					divisor := 0
-					if l[i].Type == TokenIdentInt {
-						divisor = intVars[l[i].StringData]
-					} else {
-						divisor = l[i].IntData
-					}
-
-					if divisor == 0 {
-						return nil, fmt.Errorf("Division by zero")
-					}
-
-					intVars[ident] /= divisor
-				case '&':
-					if l[i].Type == TokenIdentInt {
-						intVars[ident] &= intVars[l[i].StringData]
-					} else {
-						intVars[ident] &= l[i].IntData
-					}
-				case '|':
-					if l[i].Type == TokenIdentInt {
-						intVars[ident] |= intVars[l[i].StringData]
-					} else {
-						intVars[ident] |= l[i].IntData
-					}
-				case '^':
-					if l[i].Type == TokenIdentInt {
-						intVars[ident] ^= intVars[l[i].StringData]
-					} else {
-						intVars[ident] ^= l[i].IntData
-					}
-				default:
-					return nil, fmt.Errorf("Tried to perform an illegal integer operation")
-				}
-			} else if !identi && (l[i].Type == TokenIdentStr || l[i].Type == TokenConstStr) {
-				if mode == 'R' {
-					if l[i].Type == TokenIdentStr {
-						stringVars[ident] = stringVars[l[i].StringData]
-					} else {
-						stringVars[ident] = l[i].StringData
-					}
-				} else if mode == '+' {
-					if l[i].Type == TokenIdentStr {
-						stringVars[ident] += stringVars[l[i].StringData]
-					} else {
-						stringVars[ident] += l[i].StringData
-					}
-				} else {
-					return nil, fmt.Errorf("Tried to perform an illegal string operation")
+		start := 1
+		for i := 1; i <= len(l); i++ {
+			if i < len(l) && l[i].Type != TokenFieldSep {
+				continue
+			}
+			if start < i {
+				if !(l[start].Type == TokenIdentInt || l[start].Type == TokenIdentStr) {
+					return nil, fmt.Errorf("Not an identifier: %s", l[start].String())
 				}
-			} else if l[i].Type == TokenFieldSep {
-				ident = ""
-				mode = 'R'
-			} else if l[i].Type == TokenEq {
-				mode = 'R'
-			} else if isOperatorType(l[i].Type) {
-				switch l[i].Type {
-				case TokenAdd:
-					mode = '+'
-				case TokenSub:
-					mode = '-'
-				case TokenMul:
-					mode = '*'
-				case TokenDiv:
-					mode = '/'
-				case TokenAnd:
-					mode = '&'
-				case TokenOr:
-					mode = '|'
-				case TokenXor:
-					mode = '^'
+				if err := assign(l[start:i]); err != nil {
+					return nil, err
 				}
 			}
+			start = i + 1
 		}
+	case TokenAssert:
+		return nil, assert(l)
+	case TokenDef:
+		defineFunction(l)
 	case TokenPrint:
 		for _, token := range l[1:] {
-			switch token.Type {
-			case TokenConstInt:
-				fmt.Print(token.IntData)
-			case TokenConstStr:
-				fmt.Print(token.StringData)
-			case TokenIdentInt:
-				fmt.Print(intVars[token.StringData])
-			case TokenIdentStr:
-				fmt.Print(stringVars[token.StringData])
+			v, err := evalOperand(token)
+			if err != nil {
+				return nil, err
 			}
+			fmt.Fprint(output, v.String())
 		}
-		fmt.Println()
+		fmt.Fprintln(output)
 	default:
 		return nil, fmt.Errorf("Unexpected token in this context: %s", l[0].String())
 	}
 	return nil, nil
 }
 
-func execute(line *Line) ([]Token, error) {
+func execute(line *Line) (extraTokens []Token, err error) {
+	defer recoverError(&err)
 	return execTokenList(line.Tokens)
 }
 
-func execLines(lines []*Line) {
-	index := 0
-	ll := len(lines)
-	for index < ll {
-		if lines[index] != nil && lines[index].Used {
-			switch lines[index].Tokens[0].Type {
-			case TokenExit:
-				return
-			case TokenGoto:
-				if lines[index].Tokens[0].StringData != "" {
-					newindex := intVars[lines[index].Tokens[0].StringData]
-					if 0 <= newindex && newindex < MaxLines {
-						index = newindex
-						continue
-					} else {
-						fmt.Printf("Fatal: GOTO index %d stored in %s out-of-bounds (should be in range 0-%d)\n",
-							newindex, lines[index].Tokens[0].StringData, MaxLines)
-						return
-					}
-				}
-				index = lines[index].Tokens[0].IntData
-				continue
-			default:
-				extraTokens, err := execute(lines[index])
-				if err != nil {
-					fmt.Println(err.Error())
-					return
-				}
+var errEnd = fmt.Errorf("END")
 
-				if extraTokens != nil {
-					switch extraTokens[0].Type {
-					case TokenExit:
-						return
-					case TokenGoto:
-						index = extraTokens[0].IntData
-						continue
-					}
-				}
-			}
+// step ...
+// Executes the line at index, returning the index of the next line to run.
+func step(index int) (newindex int, err error) {
+	defer recoverError(&err)
+	switch lines[index].Tokens[0].Type {
+	case TokenSelect:
+		newindex, err := selectCase(lines, index)
+		if err == nil {
+			coverJump(newindex)
+		}
+		return newindex + 1, err
+	case TokenCase, TokenCaseElse:
+		newindex, err := endSelect(lines, index)
+		if err == nil {
+			coverJump(newindex)
 		}
-		index++
+		return newindex + 1, err
+	case TokenSubroutine, TokenFunction:
+		newindex, err := skipProcedure(lines, index)
+		return newindex + 1, err
+	case TokenTest:
+		newindex, err := skipTest(lines, index)
+		return newindex + 1, err
+	case TokenEndSelect:
+		return index + 1, nil
 	}
-}
 
-func main() {
-	var reader io.Reader
-	if len(os.Args) > 1 {
-		file, err := os.Open(os.Args[1])
+	extraTokens, err := execute(lines[index])
+	if err != nil {
+		return 0, err
+	}
+	if extraTokens == nil {
+		return index + 1, nil
+	}
+
+	switch extraTokens[0].Type {
+	case TokenExit:
+		return 0, errEnd
+	case TokenGoto:
+		return jumpTarget(extraTokens[0])
+	case TokenGosub:
+		newindex, err := jumpTarget(extraTokens[0])
 		if err != nil {
-			fmt.Fprintln(os.Stderr, err.Error())
-			os.Exit(1)
+			return 0, err
 		}
-		defer file.Close()
-		reader = file
-	} else {
-		reader = os.Stdin
+		if err := enterGosub(extraTokens[0], index+1); err != nil {
+			return 0, err
+		}
+		return newindex, nil
+	case TokenReturn:
+		return leaveGosub()
+	case TokenStop:
+		return index + 1, pause(index, reasonStop, fmt.Sprintf("BREAK IN %d", index))
+	case TokenCallSub:
+		f, err := enterProcedure(extraTokens[0], false, index+1)
+		if err != nil {
+			return 0, err
+		}
+		return f.proc.start + 1, nil
+	case TokenEndSub, TokenExitSub, TokenEndFunction, TokenExitFunction:
+		return leaveProcedure(extraTokens[0])
+	case TokenEndTest:
+		return 0, errEndTest
+	}
+	return index + 1, nil
+}
+
+// jumpTarget ...
+// Returns the index of the line a GOTO or GOSUB jumps to; either a line
+// number, a label, or a line number stored in a variable.
+func jumpTarget(t Token) (int, error) {
+	if t.StringData == "" {
+		return t.IntData, nil
+	}
+	if newindex, ok := labels[t.StringData]; ok {
+		return newindex, nil
+	}
+
+	newindex := getInt(t.StringData)
+	if newindex < 0 || MaxLines <= newindex {
+		return 0, fmt.Errorf("Fatal: %s index %d stored in %s out-of-bounds (should be in range 0-%d)",
+			strings.Fields(t.String())[0], newindex, t.StringData, MaxLines)
 	}
+	return newindex, nil
+}
 
-	scanner := bufio.NewScanner(reader)
-	for scanner.Scan() {
-		text := scanner.Text()
-		if text == "" {
+// run ...
+// Executes the program from index until it ends, or until the call stack
+// drops below depth, which means that a FUNCTION called from an expression
+// has returned.
+func run(index, depth int) error {
+	for index < len(lines) {
+		if lines[index] == nil || !lines[index].Used {
+			index++
 			continue
 		}
-		words := strings.Split(text, " ")
-		switch strings.ToUpper(words[0]) {
-		case "EXIT":
-			os.Exit(0)
-		case "RUN":
-			execLines(lines)
-			continue
-		case "REM":
-			continue
-		case "LISTDEBUG":
-			listLinesDebug()
-			continue
-		case "LIST":
-			listLines()
-			continue
-		case "VARS":
-			fmt.Println("Strings:", stringVars, "Integers:", intVars)
-			continue
+
+		currentLine = index
+		if err := checkBreak(index); err != nil {
+			return err
 		}
+		traceLine(index)
+		coverLine(index)
+		start := profileStart(index)
+		next, err := step(index)
+		profileEnd(index, start)
+		if err != nil {
+			return err
+		}
+		if len(callStack) < depth {
+			return nil
+		}
+		index = next
+	}
 
-		num, err := strconv.Atoi(words[0])
-		if err == nil {
-			if num < MaxLines && num >= 0 {
-				lines[num], err = MakeLine(strings.Join(words[1:], " "))
-				if err != nil {
-					fmt.Printf("%d: %s\n", num, err.Error())
-				}
-			} else {
-				fmt.Printf("Line number %d isn't in range 0-%d\n", num, MaxLines)
-			}
+	if len(callStack) > 0 {
+		return fmt.Errorf("Program ended inside %s", callStack[len(callStack)-1].name)
+	}
+	return nil
+}
+
+// prepareRun ...
+// Gets the program ready to run from the start.
+func prepareRun() error {
+	resetCalls()
+	if err := indexProcedures(lines); err != nil {
+		return err
+	}
+	return indexLabels(lines)
+}
+
+func execLines(lines []*Line) {
+	defer resetCalls()
+	err := prepareRun()
+	if err == nil {
+		err = run(0, 0)
+	}
+	if err != nil && err != errEnd {
+		fmt.Fprintln(output, err.Error())
+	}
+}
+
+// execImmediate ...
+// Executes a line typed without a line number.
+// If the program is paused, its calls and variables are left as they were.
+func execImmediate(line *Line) error {
+	savedCalls, savedScopes, savedLine := callStack, scopes, currentLine
+	defer func() {
+		callStack, scopes, currentLine = savedCalls, savedScopes, savedLine
+	}()
+	currentLine = -1
+	if err := indexProcedures(lines); err != nil {
+		return err
+	}
+	if err := indexLabels(lines); err != nil {
+		return err
+	}
+
+	extraTokens, err := execute(line)
+	if err != nil || extraTokens == nil || extraTokens[0].Type != TokenCallSub {
+		return err
+	}
+
+	f, err := enterProcedure(extraTokens[0], false, -1)
+	if err != nil {
+		return err
+	}
+	return run(f.proc.start+1, len(callStack))
+}
+
+func main() {
+	flag.BoolVar(&tracing, "trace", false, "show each line as it runs, like TRON")
+	traceVarsFlag := flag.Bool("trace-vars", false, "also show variables being set, like TRON VARS")
+	profileFlag := flag.Bool("profile", false, "time each line of the program, and show the slowest when it ends")
+	profileOut := flag.String("profile-out", "", "write the profile to this file, for go tool pprof")
+	coverFlag := flag.Bool("cover", false, "show the lines, and ways through IFs, which never ran when the program ends")
+	coverHTML := flag.String("cover-html", "", "write the program to this file as HTML, showing which lines ran")
+	resume := flag.String("resume", "", "start the REPL with the state saved in this file by SAVESTATE")
+	flag.Usage = func() {
+		fmt.Fprintln(os.Stderr, "Usage: ez [options] [file]\n       ez --resume state\n       ez check file...\n       ez fmt [-w] file...\n       ez xref file\n       ez dot [-lines] file\n       ez test [-update] [dir]\n       ez dap [-port N]\n       ez lsp")
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+	if *traceVarsFlag {
+		tracing, traceVars = true, true
+	}
+
+	switch flag.Arg(0) {
+	case "check":
+		checkCommand(flag.Args()[1:])
+		return
+	case "fmt":
+		formatCommand(flag.Args()[1:])
+		return
+	case "xref":
+		xrefFileCommand(flag.Args()[1:])
+		return
+	case "dot":
+		dotCommand(flag.Args()[1:])
+		return
+	case "test":
+		testCommand(flag.Args()[1:])
+		return
+	case "dap":
+		dapCommand(flag.Args()[1:])
+		return
+	case "lsp":
+		lspCommand()
+		return
+	}
+
+	if flag.NArg() > 0 {
+		src, err := ioutil.ReadFile(flag.Arg(0))
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err.Error())
+			os.Exit(1)
+		}
+		profiling = *profileFlag || *profileOut != ""
+		covering = *coverFlag || *coverHTML != ""
+		if isScript(src) {
+			runScript(src)
 		} else {
-			line, err := MakeLine(text)
-			if err != nil {
-				fmt.Println(err.Error())
-			} else {
-				_, err = execute(line)
-				if err != nil {
-					fmt.Println(err.Error())
+			_, errs := loadProgram(bytes.NewReader(src))
+			if len(errs) > 0 {
+				for _, err := range errs {
+					fmt.Fprintln(os.Stderr, err.Error())
 				}
+				os.Exit(1)
+			}
+			execLines(lines)
+		}
+		if *profileFlag {
+			writeProfileReport(os.Stderr)
+		}
+		if *profileOut != "" {
+			if err := saveProfile(*profileOut, flag.Arg(0)); err != nil {
+				fmt.Fprintln(os.Stderr, err.Error())
+				os.Exit(1)
 			}
 		}
+		if *coverFlag {
+			writeCoverageReport(os.Stderr)
+		}
+		if *coverHTML != "" {
+			if err := saveCoverageHTML(*coverHTML, flag.Arg(0)); err != nil {
+				fmt.Fprintln(os.Stderr, err.Error())
+				os.Exit(1)
+			}
+		}
+		return
 	}
 
-	if err := scanner.Err(); err != nil {
-		fmt.Fprintln(os.Stderr, err.Error())
-		os.Exit(1)
+	if *resume != "" {
+		if err := loadState(*resume); err != nil {
+			fmt.Fprintln(os.Stderr, err.Error())
+			os.Exit(1)
+		}
 	}
+	repl()
 }
@@ -0,0 +1,499 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"encoding/binary"
+	"io/ioutil"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+// runProgram runs src as a program, with input as its standard input, and
+// returns what it printed.
+func runProgram(t *testing.T, src, input string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "test.bas")
+	if err := ioutil.WriteFile(path, []byte(src), 0644); err != nil {
+		t.Fatal(err)
+	}
+	out, _, err := runGolden(path, []byte(input), 5*time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(out)
+}
+
+func TestStatements(t *testing.T) {
+	tests := []struct {
+		name, src, input, want string
+	}{
+		{"print", `PRINT "a" 1 "b"`, "", "a1b\n"},
+		{"let", "LET a = 2 ; b = a * 3 ; a + 1\nPRINT a \" \" b", "", "3 6\n"},
+		{"arithmetic", "LET a = 7 / 2 ; b = 7 - 2 * 3 ; c = 6 & 3 ; d = 6 | 3 ; e = 6 ^ 3\nPRINT a b c d e", "",
+			"315275\n"},
+		{"division by zero", "LET a = 1 / 0", "", "Division by zero\n"},
+		{"strings", "LET s$ = \"ab\" + \"cd\"\nPRINT s$", "", "abcd\n"},
+		{"mixed", `LET s$ = "a" + 1`, "", "Tried to perform an illegal string operation\n"},
+		{"input", "INPUT \"n? \" n\nINPUT \"s? \" s$\nPRINT n s$", "42\nhi\n", "n? s? 42hi\n"},
+		{"input prompt variable", "LET p$ = \"> \"\nINPUT p$ n\nPRINT n", "5\n", "> 5\n"},
+		{"input eof", "INPUT \"n? \" n\nPRINT n", "", "n? 0\n"},
+		{"if", "LET a = 2\nIF a > 1 THEN PRINT \"big\" ELSE PRINT \"small\"\nIF a = 1 THEN PRINT \"one\"", "",
+			"big\n"},
+		{"if length", "IF \"abc\" = 3 THEN PRINT \"yes\"", "", "yes\n"},
+		{"goto", "GOTO 30\nPRINT \"skipped\"\nPRINT \"here\"", "", "here\n"},
+		{"computed goto", "LET to = 40\nGOTO to\nPRINT \"skipped\"\nPRINT \"here\"", "", "here\n"},
+		{"gosub", "GOSUB sub\nPRINT \"back\"\nEND\nsub:\nPRINT \"in\"\nRETURN", "", "in\nback\n"},
+		{"return without gosub", "RETURN", "", "RETURN without GOSUB\n"},
+		{"end", "PRINT 1\nEND\nPRINT 2", "", "1\n"},
+		{"select", "LET a = 5\nSELECT CASE a\nCASE 1, 2\nPRINT \"low\"\nCASE IS > 9\nPRINT \"high\"\n" +
+			"CASE 3 TO 6\nPRINT \"mid\"\nCASE ELSE\nPRINT \"other\"\nEND SELECT", "", "mid\n"},
+		{"case else", "SELECT CASE \"x\"\nCASE \"y\"\nPRINT \"y\"\nCASE ELSE\nPRINT \"else\"\nEND SELECT", "", "else\n"},
+		{"def", "DEF fnsq(x) = x * x\nPRINT fnsq(4)", "", "16\n"},
+		{"sub", "CALL greet(\"you\")\nEND\nSUB greet(who$)\nPRINT \"hi \" who$\nEND SUB", "", "hi you\n"},
+		{"byref", "LET a = 1 ; b = 2\nCALL swap(a, b)\nPRINT a b\nEND\nSUB swap(BYREF x, BYREF y)\nLOCAL t\n" +
+			"LET t = x ; x = y ; y = t\nEND SUB", "", "21\n"},
+		{"function", "PRINT fact(5)\nEND\nFUNCTION fact(n)\nIF n <= 1 THEN LET fact = 1 ELSE LET fact = n * fact(n - 1)\n" +
+			"END FUNCTION", "", "120\n"},
+		{"exit sub", "CALL s\nPRINT \"after\"\nEND\nSUB s\nPRINT \"in\"\nEXIT SUB\nPRINT \"skipped\"\nEND SUB", "",
+			"in\nafter\n"},
+		{"local", "LET a = 1\nCALL s\nPRINT a\nEND\nSUB s\nLOCAL a\nLET a = 2\nEND SUB", "", "1\n"},
+		{"stop", "PRINT 1\nSTOP\nPRINT 2", "", "1\nBREAK IN 20\n"},
+		{"tron", "TRON\nPRINT 1\nTROFF\nPRINT 2", "", "[20]\n1\n[30]\n2\n"},
+		{"parse error", "PRINT 1\nFROB", "", "20: Unknown keyword FROB\n"},
+		{"auto numbering", "PRINT 1\nPRINT 2\n15 PRINT 3", "", "1\n3\n2\n"},
+		{"auto number taken", "20 PRINT \"B\"\n10 PRINT \"A\"\nPRINT \"C\"", "",
+			"20: Unnumbered line would be numbered 20, which is already used by line 1\n"},
+		{"number taken by auto", "PRINT \"A\"\n10 PRINT \"B\"", "",
+			"10: Line number is already used by the unnumbered line on line 1\n"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if got := runProgram(t, test.src, test.input); got != test.want {
+				t.Errorf("got %q, want %q", got, test.want)
+			}
+		})
+	}
+}
+
+func TestGolden(t *testing.T) {
+	paths, err := filepath.Glob("testdata/*.bas")
+	if err != nil || len(paths) == 0 {
+		t.Fatalf("no programs in testdata: %v", err)
+	}
+	tests := make(map[string]int)
+	for _, path := range paths {
+		base := strings.TrimSuffix(path, ".bas")
+		in, _ := ioutil.ReadFile(base + ".in")
+		got, results, err := runGolden(path, in, 10*time.Second)
+		if err != nil {
+			t.Errorf("%s: %v", path, err)
+			continue
+		}
+		for _, r := range results {
+			if r.err != nil {
+				t.Errorf("%s: TEST \"%s\": %v\n%s", path, r.name, r.err, r.output)
+			}
+			tests[path]++
+		}
+		want, err := ioutil.ReadFile(base + ".out")
+		if err != nil {
+			t.Errorf("%s: %v", path, err)
+		} else if !bytes.Equal(want, got) {
+			t.Errorf("%s:\n%s", path, diffLines(want, got))
+		}
+	}
+	if n := tests["testdata/asserts.bas"]; n != 3 {
+		t.Errorf("ran %d TESTs in asserts.bas, want 3", n)
+	}
+}
+
+func TestCoverage(t *testing.T) {
+	covering = true
+	defer func() { covering = false }()
+	resetCoverage()
+	runProgram(t, "LET a = 3\nIF a > 1 THEN PRINT a\nSELECT CASE a\nCASE 1\nPRINT 1\nCASE 3\nPRINT 3\nEND SELECT\n"+
+		"END\nSUB s\nPRINT 4\nEND SUB", "")
+	want := "7 of 11 lines run (63.6%), 1 of 2 IF branches taken (50.0%)"
+	if got := coverageString(); got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+	if got := missed(20); got != "IF never false" {
+		t.Errorf("line 20: got %q, want IF never false", got)
+	}
+}
+
+func TestProfile(t *testing.T) {
+	profiling = true
+	defer func() { profiling = false }()
+	resetProfile()
+	if got := runProgram(t, "PRINT fact(4)\nEND\nFUNCTION fact(n)\n"+
+		"IF n <= 1 THEN LET fact = 1 ELSE LET fact = n * fact(n - 1)\nEND FUNCTION", ""); got != "24\n" {
+		t.Fatalf("got %q, want \"24\\n\"", got)
+	}
+
+	counts := make(map[int]int)
+	var flat time.Duration
+	runs := 0
+	for index, p := range profileLines {
+		counts[index] = p.count
+		flat += p.flat
+		runs += p.count
+		if p.cum < p.flat {
+			t.Errorf("line %d: cum %s is less than flat %s", index, p.cum, p.flat)
+		}
+	}
+	if want := map[int]int{10: 1, 20: 1, 40: 4, 50: 4}; !reflect.DeepEqual(counts, want) {
+		t.Errorf("got counts %v, want %v", counts, want)
+	}
+	if cum := profileLines[10].cum; cum > flat {
+		t.Errorf("line 10 took %s, more than the %s all of the lines took", cum, flat)
+	}
+
+	var buf bytes.Buffer
+	if err := writePprof(&buf, "fact.bas"); err != nil {
+		t.Fatal(err)
+	}
+	gz, err := gzip.NewReader(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := ioutil.ReadAll(gz)
+	if err != nil {
+		t.Fatal(err)
+	}
+	samples, sampled, total := 0, 0, time.Duration(0)
+	for _, f := range protoFields(t, data) {
+		switch f.field {
+		case 2:
+			samples++
+			for _, v := range protoFields(t, f.data) {
+				if v.field == 2 {
+					values := protoVarints(t, v.data)
+					sampled += int(values[0])
+				}
+			}
+		case 10:
+			total = time.Duration(f.value)
+		}
+	}
+	// Lines 40 and 50 are each run from 10, then from 40 called from 10, and
+	// so on, giving a sample for each depth
+	if samples != 2+4+4 {
+		t.Errorf("got %d samples, want %d", samples, 2+4+4)
+	}
+	if sampled != runs {
+		t.Errorf("samples count %d lines run, want %d", sampled, runs)
+	}
+	if total != flat {
+		t.Errorf("profile lasts %s, want the %s the lines took", total, flat)
+	}
+}
+
+// protoField ...
+// A field of a protocol buffer message: value for a varint, data for bytes
+type protoField struct {
+	field int
+	value uint64
+	data  []byte
+}
+
+// protoVarints ...
+// Decodes data as a run of varints, as in a packed repeated field.
+func protoVarints(t *testing.T, data []byte) []uint64 {
+	t.Helper()
+	ret := []uint64{}
+	for len(data) > 0 {
+		x, n := binary.Uvarint(data)
+		if n <= 0 {
+			t.Fatal("bad varint")
+		}
+		ret = append(ret, x)
+		data = data[n:]
+	}
+	return ret
+}
+
+// protoFields ...
+// Decodes the fields of a protocol buffer message which only uses varints
+// and bytes, as writePprof does.
+func protoFields(t *testing.T, data []byte) []protoField {
+	t.Helper()
+	ret := []protoField{}
+	for len(data) > 0 {
+		key, n := binary.Uvarint(data)
+		if n <= 0 {
+			t.Fatal("bad key")
+		}
+		data = data[n:]
+		f := protoField{field: int(key >> 3)}
+		x, n := binary.Uvarint(data)
+		if n <= 0 {
+			t.Fatal("bad varint")
+		}
+		data = data[n:]
+		switch key & 7 {
+		case 0:
+			f.value = x
+		case 2:
+			if uint64(len(data)) < x {
+				t.Fatal("bad length")
+			}
+			f.data, data = data[:x], data[x:]
+		default:
+			t.Fatalf("unexpected wire type %d", key&7)
+		}
+		ret = append(ret, f)
+	}
+	return ret
+}
+
+func TestCheckDuplicates(t *testing.T) {
+	tests := []struct {
+		src  string
+		want warning
+	}{
+		{"CALL s\nEND\nSUB s\nEND SUB\nSUB s\nEND SUB", warning{50, "s is declared more than once"}},
+		{"top:\nPRINT 1\ntop:\nGOTO top", warning{30, "Label top is already declared on line 10"}},
+	}
+	for _, test := range tests {
+		prog, errs := parseProgram(strings.NewReader(test.src))
+		if len(errs) > 0 {
+			t.Fatal(errs)
+		}
+		got := checkProgram(prog)
+		if !reflect.DeepEqual(got, []warning{test.want}) {
+			t.Errorf("%q: got %v, want %v", test.src, got, test.want)
+			continue
+		}
+		// ez check shows the line of the file each warning is on
+		if prog[got[0].index] == nil {
+			t.Errorf("%q: warning is on line %d, which doesn't exist", test.src, got[0].index)
+		}
+	}
+}
+
+func TestCheckSelect(t *testing.T) {
+	// The end of a CASE goes to END SELECT, as ez dot shows
+	prog, errs := parseProgram(strings.NewReader("INPUT \"x \" x\nSELECT CASE x\nCASE 1\nPRINT 1\nCASE ELSE\n" +
+		"GOTO 10\nEND SELECT\nEND"))
+	if len(errs) > 0 {
+		t.Fatal(errs)
+	}
+	if got := checkProgram(prog); len(got) != 0 {
+		t.Errorf("got %v, want no warnings", got)
+	}
+}
+
+func TestXref(t *testing.T) {
+	prog, errs := parseProgram(strings.NewReader("10 LET a = 1\n20 IF a > 3 THEN GOTO 50\n30 LET a + 1 ; b = a\n" +
+		"40 GOTO 20\n50 CALL s(b)\n60 END\n70 SUB s(BYREF x)\n80 LET x = 2\n90 END SUB"))
+	if len(errs) > 0 {
+		t.Fatal(errs)
+	}
+	running := map[string]*procedure{"t": {start: 100}}
+	procedures = running
+	x, err := xref(prog)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(procedures, running) {
+		t.Errorf("xref changed the procedures of the running program to %v", procedures)
+	}
+	want := map[string]references{
+		"a": {read: []int{20, 30}, written: []int{10, 30}},
+		"b": {written: []int{30, 50}},
+		"x": {written: []int{70, 80}},
+	}
+	for name, refs := range want {
+		if got := x.vars[name]; got == nil || !reflect.DeepEqual(*got, refs) {
+			t.Errorf("%s: got %v, want %v", name, got, refs)
+		}
+	}
+	if got := x.targets[20].gotos; !reflect.DeepEqual(got, []int{40}) {
+		t.Errorf("line 20: got GOTO from %v, want [40]", got)
+	}
+}
+
+func TestControlFlow(t *testing.T) {
+	prog, errs := parseProgram(strings.NewReader("10 IF a > 1 THEN GOTO 40 ELSE PRINT a\n20 GOTO a\n" +
+		"30 SUB s\n35 END SUB\n40 CALL s\n50 END"))
+	if len(errs) > 0 {
+		t.Fatal(errs)
+	}
+	g, err := controlFlow(prog)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []flowEdge{
+		{10, 40, "THEN GOTO", flowJump, ""},
+		{10, 20, "ELSE", flowNext, ""},
+		{20, unknownLine, "GOTO a", flowComputed, ""},
+		{30, 35, "", flowNext, ""},
+		{40, 30, "CALL s", flowCall, "s"},
+		{40, 50, "", flowReturn, "s"},
+	}
+	if !reflect.DeepEqual(g.edges, want) {
+		t.Errorf("got %v, want %v", g.edges, want)
+	}
+}
+
+func TestSaveState(t *testing.T) {
+	clearProgram()
+	clearVars()
+	for num, text := range map[int]string{10: "DEF fnadd(a, b) = a + b", 20: "PRINT fnadd(x, 1) s$"} {
+		if err := storeLine(num, text); err != nil {
+			t.Fatal(err)
+		}
+	}
+	execute(lines[10])
+	setInt("x", 41)
+	setStr("s$", "!")
+
+	var buf bytes.Buffer
+	if err := writeState(&buf); err != nil {
+		t.Fatal(err)
+	}
+	saved := buf.String()
+	clearProgram()
+	clearVars()
+	snap, prog, err := readState(strings.NewReader(saved))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := restoreState(snap, prog); err != nil {
+		t.Fatal(err)
+	}
+	if got := runLines(t); got != "42!\n" {
+		t.Errorf("got %q after restoring, want \"42!\\n\"", got)
+	}
+
+	if _, _, err := readState(strings.NewReader(strings.Replace(saved, `"version": 1`, `"version": 99`, 1))); err == nil {
+		t.Error("expected an error for the wrong version")
+	}
+
+	// Checking a state paused inside a SUB leaves the running program alone
+	paused := `{"version": 1, "lines": [{"number": 10, "text": "CALL s"}, {"number": 20, "text": "END"},
+		{"number": 30, "text": "SUB s"}, {"number": 40, "text": "END SUB"}], "paused": true, "index": 40,
+		"calls": [{"name": "s", "ret": 20, "from": 10, "scope": 0}], "scopes": [{}]}`
+	running := map[string]*procedure{"t": {start: 100}}
+	procedures = running
+	if _, _, err := readState(strings.NewReader(paused)); err != nil {
+		t.Error(err)
+	}
+	if _, _, err := readState(strings.NewReader(strings.Replace(paused, `"name": "s"`, `"name": "u"`, 1))); err == nil {
+		t.Error("expected an error for a call to a SUB that isn't in the program")
+	}
+	if !reflect.DeepEqual(procedures, running) {
+		t.Errorf("readState changed the procedures of the running program to %v", procedures)
+	}
+	for _, frame := range []string{`"ret": -5, "from": 10`, `"ret": -1, "from": 10`, `"ret": 20, "from": 100000`} {
+		bad := strings.Replace(paused, `"ret": 20, "from": 10`, frame, 1)
+		if _, _, err := readState(strings.NewReader(bad)); err == nil {
+			t.Errorf("expected an error for a call with %s", frame)
+		}
+	}
+}
+
+// runLines runs the loaded program, keeping its variables, and returns what
+// it printed.
+func runLines(t *testing.T) string {
+	t.Helper()
+	var buf bytes.Buffer
+	saved := output
+	output = &buf
+	defer func() { output = saved }()
+	execLines(lines)
+	return buf.String()
+}
+
+func TestBreakpointsFollowLines(t *testing.T) {
+	clearProgram()
+	defer setBreakpoints(nil)
+	for _, num := range []int{10, 20, 30} {
+		if err := storeLine(num, "PRINT 1"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	setBreakpoints([]int{5, 20, 25, 30})
+	if _, err := renumber(100, 10, 20); err != nil {
+		t.Fatal(err)
+	}
+	if want := map[int]bool{5: true, 100: true, 110: true}; !reflect.DeepEqual(breakpoints, want) {
+		t.Errorf("after RENUM got %v, want %v", breakpoints, want)
+	}
+	deleteCommand([]string{"100-105"})
+	if want := map[int]bool{5: true, 110: true}; !reflect.DeepEqual(breakpoints, want) {
+		t.Errorf("after DELETE got %v, want %v", breakpoints, want)
+	}
+}
+
+func TestCompletions(t *testing.T) {
+	if got := completions("ex"); !reflect.DeepEqual(got, []string{"EXIT"}) {
+		t.Errorf("got %v, want [EXIT]", got)
+	}
+}
+
+func TestHistory(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "history")
+	e := newLineEditor(path, completions)
+	e.addHistory("PRINT 1")
+	e.addHistory("PRINT 1")
+	e.addHistory("LIST")
+	if got := newLineEditor(path, completions).history; !reflect.DeepEqual(got, []string{"PRINT 1", "LIST"}) {
+		t.Errorf("got history %v, want [PRINT 1 LIST]", got)
+	}
+
+	// A history that can't be saved is reported once, then not saved
+	e = newLineEditor(filepath.Join(path, "not a directory"), completions)
+	e.addHistory("LIST")
+	if e.histPath != "" {
+		t.Error("expected saving the history to stop after it failed")
+	}
+}
+
+func TestPanicsAreErrors(t *testing.T) {
+	fn := func() (err error) {
+		defer recoverError(&err)
+		panic("deliberate")
+	}
+	if err, ok := fn().(panicError); !ok || err.value != "deliberate" {
+		t.Errorf("got %v, want a panicError", err)
+	}
+
+	// A statement missing its operands is an ordinary error
+	_, err := execute(&Line{Used: true, Tokens: []Token{tok(TokenInput)}})
+	if err != errInvalidInput {
+		t.Errorf("INPUT without operands got %v, want %v", err, errInvalidInput)
+	}
+}
+
+func FuzzExecute(f *testing.F) {
+	for _, seed := range []string{`LET a = 1 ; b$ = "x y"`, `IF a > 1 THEN PRINT "a" ELSE GOTO 10`,
+		`INPUT "p " a`, `PRINT fnf(1)`, `DEF fnf(a) = a / 0`, `LET a = 1 + "x"`, `IF a THEN PRINT a`} {
+		f.Add(seed)
+	}
+	savedOutput, savedStdin := output, stdin
+	defer func() { output, stdin = savedOutput, savedStdin }()
+	output = ioutil.Discard
+	f.Fuzz(func(t *testing.T, text string) {
+		line, err := MakeLine(text)
+		if err != nil || !line.Used {
+			return
+		}
+		clearProgram()
+		clearVars()
+		resetCalls()
+		currentLine = -1
+		stdin = bufio.NewReader(strings.NewReader("1\n"))
+		if _, err := execute(line); err != nil {
+			if _, ok := err.(panicError); ok {
+				t.Fatalf("%q: %v", text, err)
+			}
+		}
+	})
+}
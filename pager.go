@@ -0,0 +1,51 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+)
+
+// DefaultHeight ...
+// Number of rows assumed when the size of the terminal can't be found
+const DefaultHeight int = 24
+
+var errStopPaging = fmt.Errorf("Stopped")
+
+// pager ...
+// A writer which pauses after every screenful of lines until Enter is pressed.
+type pager struct {
+	w      io.Writer
+	height int
+	count  int
+}
+
+func newPager(w io.Writer) *pager {
+	height := terminalHeight(os.Stdout)
+	if height <= 1 {
+		height = DefaultHeight
+	}
+	return &pager{w: w, height: height}
+}
+
+func (p *pager) Write(b []byte) (int, error) {
+	if p.count >= p.height-1 {
+		fmt.Fprint(p.w, "-- More (Enter to continue, Q to stop) --")
+		answer, err := readInputLine()
+		if err != nil || strings.ToUpper(strings.TrimSpace(answer)) == "Q" {
+			return 0, errStopPaging
+		}
+		p.count = 0
+	}
+	p.count += bytes.Count(b, []byte("\n"))
+	return p.w.Write(b)
+}
+
+// isTerminal ...
+// Checks whether f is a terminal rather than a file or a pipe.
+func isTerminal(f *os.File) bool {
+	info, err := f.Stat()
+	return err == nil && info.Mode()&os.ModeCharDevice != 0
+}
@@ -0,0 +1,228 @@
+package main
+
+import (
+	"fmt"
+)
+
+// procedure ...
+// A SUB or FUNCTION declared in the program
+type procedure struct {
+	start    int
+	function bool
+	params   []Token
+	byref    []bool
+}
+
+// frame ...
+// An active call to a SUB or FUNCTION, or a GOSUB if proc is nil. from is the
+// line the call was made on.
+type frame struct {
+	name   string
+	proc   *procedure
+	ret    int
+	from   int
+	scope  *scope
+	result value
+}
+
+var procedures = make(map[string]*procedure)
+var callStack []*frame
+
+// currentLine is the index of the line being run
+var currentLine int
+
+// indexProcedures ...
+// Finds the SUB and FUNCTION declarations in the program, for it to run.
+func indexProcedures(lines []*Line) error {
+	procs, err := findProcedures(lines)
+	if err != nil {
+		return err
+	}
+	procedures = procs
+	return nil
+}
+
+// findProcedures ...
+// Returns the SUB and FUNCTION declarations in a program by name.
+func findProcedures(lines []*Line) (map[string]*procedure, error) {
+	procs := make(map[string]*procedure)
+	for i, line := range lines {
+		if line == nil || !line.Used {
+			continue
+		}
+		header := line.Tokens[0]
+		if header.Type != TokenSubroutine && header.Type != TokenFunction {
+			continue
+		}
+		if _, ok := procs[header.StringData]; ok {
+			return nil, lineError{i, fmt.Errorf("%s is declared more than once", header.StringData)}
+		}
+
+		proc := &procedure{start: i, function: header.Type == TokenFunction}
+		byref := false
+		for _, token := range line.Tokens[1:] {
+			switch token.Type {
+			case TokenByRef:
+				byref = true
+			case TokenIdentInt, TokenIdentStr:
+				proc.params = append(proc.params, token)
+				proc.byref = append(proc.byref, byref)
+				byref = false
+			}
+		}
+		procs[header.StringData] = proc
+	}
+	return procs, nil
+}
+
+// skipProcedure ...
+// Returns the index of the END SUB or END FUNCTION closing the declaration on
+// line index, so that declarations are skipped over when not called.
+func skipProcedure(lines []*Line, index int) (int, error) {
+	header := lines[index].Tokens[0]
+	end := TokenEndSub
+	if header.Type == TokenFunction {
+		end = TokenEndFunction
+	}
+
+	for i := index + 1; i < len(lines); i++ {
+		if lines[i] == nil || !lines[i].Used {
+			continue
+		}
+		switch lines[i].Tokens[0].Type {
+		case end:
+			return i, nil
+		case TokenSubroutine, TokenFunction:
+			return 0, fmt.Errorf("%d: %s is declared inside %s", i, lines[i].Tokens[0].StringData, header.StringData)
+		}
+	}
+	return 0, fmt.Errorf("%s without %s", header.String(), Token{Type: end}.String())
+}
+
+// enterProcedure ...
+// Binds the arguments of a call to the parameters of a SUB or FUNCTION and
+// pushes a new frame. Execution of the body should continue after proc.start;
+// ret is the index of the line to return to.
+func enterProcedure(t Token, function bool, ret int) (*frame, error) {
+	proc, ok := procedures[t.StringData]
+	if !ok {
+		return nil, fmt.Errorf("Undefined procedure %s", t.StringData)
+	}
+	if proc.function != function {
+		if function {
+			return nil, fmt.Errorf("%s is a SUB, and must be used with CALL", t.StringData)
+		}
+		return nil, fmt.Errorf("%s is a FUNCTION, and can't be used with CALL", t.StringData)
+	}
+	if len(proc.params) != len(t.Args) {
+		return nil, fmt.Errorf("%s expects %d arguments, got %d", t.StringData, len(proc.params), len(t.Args))
+	}
+
+	s := newScope()
+	for i, param := range proc.params {
+		arg := t.Args[i]
+		if proc.byref[i] {
+			if len(arg) != 1 || arg[0].Type != param.Type {
+				return nil, fmt.Errorf("BYREF parameter %s of %s needs a variable of the same type", param.StringData, t.StringData)
+			}
+			s.refs[param.StringData] = resolve(arg[0])
+			continue
+		}
+
+		v, err := evalExpr(arg)
+		if err != nil {
+			return nil, err
+		}
+		if param.Type == TokenIdentStr && v.isStr {
+			s.strs[param.StringData] = v.s
+		} else if param.Type == TokenIdentInt && !v.isStr {
+			s.ints[param.StringData] = v.i
+		} else {
+			return nil, fmt.Errorf("Type mismatch for parameter %s of %s", param.StringData, t.StringData)
+		}
+	}
+
+	// A FUNCTION returns the value assigned to its own name
+	if function {
+		if _, stringp := validIdentifierStrP(t.StringData); stringp {
+			s.strs[t.StringData] = ""
+		} else {
+			s.ints[t.StringData] = 0
+		}
+	}
+
+	if err := pushScope(s); err != nil {
+		return nil, err
+	}
+	f := &frame{name: t.StringData, proc: proc, ret: ret, from: currentLine, scope: s}
+	callStack = append(callStack, f)
+	return f, nil
+}
+
+// leaveProcedure ...
+// Pops the current frame on END SUB, EXIT SUB, END FUNCTION or EXIT FUNCTION
+// and returns the index of the line to return to.
+func leaveProcedure(t Token) (int, error) {
+	function := t.Type == TokenEndFunction || t.Type == TokenExitFunction
+	if len(callStack) == 0 || callStack[len(callStack)-1].proc == nil ||
+		callStack[len(callStack)-1].proc.function != function {
+		return 0, fmt.Errorf("%s outside of a call", t.String())
+	}
+
+	f := callStack[len(callStack)-1]
+	callStack = callStack[:len(callStack)-1]
+	popScope()
+
+	if function {
+		if _, stringp := validIdentifierStrP(f.name); stringp {
+			f.result = value{isStr: true, s: f.scope.strs[f.name]}
+		} else {
+			f.result = value{i: f.scope.ints[f.name]}
+		}
+	}
+	return f.ret, nil
+}
+
+// callProcedure ...
+// Runs a FUNCTION called from inside an expression and returns its result.
+func callProcedure(t Token) (value, error) {
+	f, err := enterProcedure(t, true, -1)
+	if err != nil {
+		return value{}, err
+	}
+	from := currentLine
+	err = run(f.proc.start+1, len(callStack))
+	currentLine = from
+	if err != nil {
+		return value{}, err
+	}
+	return f.result, nil
+}
+
+// enterGosub ...
+// Pushes a frame for a GOSUB, which RETURN will go back to. Unlike a call to
+// a SUB, a GOSUB doesn't get its own variables.
+func enterGosub(t Token, ret int) error {
+	if len(callStack) >= MaxCallDepth {
+		return fmt.Errorf("Too many nested calls (maximum %d)", MaxCallDepth)
+	}
+	callStack = append(callStack, &frame{name: t.String(), ret: ret, from: currentLine})
+	return nil
+}
+
+// leaveGosub ...
+// Pops the frame pushed by the last GOSUB and returns the index of the line
+// after it.
+func leaveGosub() (int, error) {
+	if len(callStack) == 0 || callStack[len(callStack)-1].proc != nil {
+		return 0, fmt.Errorf("RETURN without GOSUB")
+	}
+	f := callStack[len(callStack)-1]
+	callStack = callStack[:len(callStack)-1]
+	return f.ret, nil
+}
+
+func resetCalls() {
+	callStack = nil
+	scopes = nil
+}
@@ -0,0 +1,273 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+// profiling is set by --profile, to time each line of the program
+var profiling bool
+
+// lineProfile ...
+// How many times a line ran, and how long it took. flat leaves out the time
+// spent in FUNCTIONs it called, and cum doesn't, without counting recursive
+// calls twice. active is the number of times the line is running right now.
+type lineProfile struct {
+	count  int
+	flat   time.Duration
+	cum    time.Duration
+	active int
+}
+
+// profileSample ...
+// The time spent on a line, called from the lines in the rest of stack, in
+// the form pprof wants
+type profileSample struct {
+	stack []int
+	count int64
+	flat  time.Duration
+}
+
+// activation ...
+// A line being run, with the time spent in the lines it called so far
+type activation struct {
+	stack    []int
+	children time.Duration
+}
+
+var profileLines = make(map[int]*lineProfile)
+var profileSamples = make(map[string]*profileSample)
+var activations []*activation
+var profileStarted = time.Now()
+
+// resetProfile ...
+// Forgets the lines profiled so far, before running another program.
+func resetProfile() {
+	profileLines = make(map[int]*lineProfile)
+	profileSamples = make(map[string]*profileSample)
+	activations = nil
+	profileStarted = time.Now()
+}
+
+// profileStart ...
+// Called before line index runs. Returns the time it started.
+func profileStart(index int) time.Time {
+	if !profiling {
+		return time.Time{}
+	}
+	p, ok := profileLines[index]
+	if !ok {
+		p = &lineProfile{}
+		profileLines[index] = p
+	}
+	p.count++
+	p.active++
+
+	// The line, then the lines the calls it's inside were made from
+	stack := []int{index}
+	for i := len(callStack) - 1; i >= 0; i-- {
+		if callStack[i].from >= 0 {
+			stack = append(stack, callStack[i].from)
+		}
+	}
+	activations = append(activations, &activation{stack: stack})
+	return time.Now()
+}
+
+// profileEnd ...
+// Called after line index has run.
+func profileEnd(index int, start time.Time) {
+	if !profiling {
+		return
+	}
+	elapsed := time.Since(start)
+	a := activations[len(activations)-1]
+	activations = activations[:len(activations)-1]
+	if len(activations) > 0 {
+		activations[len(activations)-1].children += elapsed
+	}
+
+	p := profileLines[index]
+	p.flat += elapsed - a.children
+	p.active--
+	if p.active == 0 {
+		p.cum += elapsed
+	}
+
+	var key strings.Builder
+	for _, i := range a.stack {
+		key.WriteString(strconv.Itoa(i))
+		key.WriteString(" ")
+	}
+	s, ok := profileSamples[key.String()]
+	if !ok {
+		s = &profileSample{stack: a.stack}
+		profileSamples[key.String()] = s
+	}
+	s.count++
+	s.flat += elapsed - a.children
+}
+
+// writeProfileReport ...
+// Writes the lines which ran, the ones which took longest first.
+func writeProfileReport(w io.Writer) {
+	indexes := []int{}
+	var total time.Duration
+	runs := 0
+	for index, p := range profileLines {
+		indexes = append(indexes, index)
+		total += p.flat
+		runs += p.count
+	}
+	sort.Slice(indexes, func(i, j int) bool {
+		a, b := profileLines[indexes[i]], profileLines[indexes[j]]
+		if a.flat != b.flat {
+			return a.flat > b.flat
+		}
+		return indexes[i] < indexes[j]
+	})
+
+	fmt.Fprintf(w, "%d lines run in %s\n", runs, total.Round(time.Microsecond))
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', tabwriter.AlignRight)
+	fmt.Fprintln(tw, "LINE\tCOUNT\tFLAT\tFLAT%\tCUM\t")
+	for _, index := range indexes {
+		p := profileLines[index]
+		percent := 0.0
+		if total > 0 {
+			percent = 100 * float64(p.flat) / float64(total)
+		}
+		fmt.Fprintf(tw, "%d\t%d\t%s\t%.1f%%\t%s\t  %s\n", index, p.count, p.flat.Round(time.Microsecond),
+			percent, p.cum.Round(time.Microsecond), lines[index].Content)
+	}
+	tw.Flush()
+}
+
+// protoBuffer ...
+// Just enough of the protocol buffer encoding to write a pprof profile
+type protoBuffer struct {
+	bytes.Buffer
+}
+
+func (b *protoBuffer) varint(x uint64) {
+	for x >= 0x80 {
+		b.WriteByte(byte(x) | 0x80)
+		x >>= 7
+	}
+	b.WriteByte(byte(x))
+}
+
+func (b *protoBuffer) uint(field int, x uint64) {
+	if x == 0 {
+		return
+	}
+	b.varint(uint64(field) << 3)
+	b.varint(x)
+}
+
+func (b *protoBuffer) bytes(field int, data []byte) {
+	b.varint(uint64(field)<<3 | 2)
+	b.varint(uint64(len(data)))
+	b.Write(data)
+}
+
+func (b *protoBuffer) packed(field int, xs []uint64) {
+	var inner protoBuffer
+	for _, x := range xs {
+		inner.varint(x)
+	}
+	b.bytes(field, inner.Bytes())
+}
+
+// writePprof ...
+// Writes the profile in the gzipped protocol buffer format read by go tool
+// pprof. Each line of the program is a function, named after the line and
+// its contents, and the SUBs, FUNCTIONs and GOSUBs a line was run from are
+// its callers. filename is the file the program was loaded from.
+func writePprof(w io.Writer, filename string) error {
+	strs := []string{""}
+	str := func(s string) uint64 {
+		strs = append(strs, s)
+		return uint64(len(strs) - 1)
+	}
+	valueType := func(typ, unit string) []byte {
+		var vt protoBuffer
+		vt.uint(1, str(typ))
+		vt.uint(2, str(unit))
+		return vt.Bytes()
+	}
+
+	var p protoBuffer
+	p.bytes(1, valueType("samples", "count"))
+	p.bytes(1, valueType("wall", "nanoseconds"))
+
+	var total time.Duration
+	for _, s := range profileSamples {
+		var sample protoBuffer
+		ids := make([]uint64, len(s.stack))
+		for i, index := range s.stack {
+			ids[i] = uint64(index) + 1
+		}
+		sample.packed(1, ids)
+		sample.packed(2, []uint64{uint64(s.count), uint64(s.flat)})
+		p.bytes(2, sample.Bytes())
+		total += s.flat
+	}
+
+	file := str(filename)
+	for index := range lines {
+		if lines[index] == nil || !lines[index].Used {
+			continue
+		}
+		id := uint64(index) + 1
+		var line, location, function protoBuffer
+		line.uint(1, id)
+		line.uint(2, uint64(lines[index].Source))
+		location.uint(1, id)
+		location.bytes(4, line.Bytes())
+		p.bytes(4, location.Bytes())
+
+		name := str(fmt.Sprintf("%d %s", index, lines[index].Content))
+		function.uint(1, id)
+		function.uint(2, name)
+		function.uint(3, name)
+		function.uint(4, file)
+		function.uint(5, uint64(lines[index].Source))
+		p.bytes(5, function.Bytes())
+	}
+
+	p.uint(9, uint64(profileStarted.UnixNano()))
+	p.uint(10, uint64(total))
+	p.bytes(11, valueType("wall", "nanoseconds"))
+	p.uint(12, 1)
+	for _, s := range strs {
+		p.bytes(6, []byte(s))
+	}
+
+	gz := gzip.NewWriter(w)
+	if _, err := gz.Write(p.Bytes()); err != nil {
+		return err
+	}
+	return gz.Close()
+}
+
+// saveProfile ...
+// Writes the profile for go tool pprof to the file path.
+func saveProfile(path, program string) error {
+	file, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	if err := writePprof(file, program); err != nil {
+		file.Close()
+		return err
+	}
+	return file.Close()
+}
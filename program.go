@@ -0,0 +1,187 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+)
+
+// AutoStep ...
+// Gap between lines which are numbered automatically when loading a program
+const AutoStep int = 10
+
+var labels = make(map[string]int)
+
+// storeLine ...
+// Parses text and stores it in the program as line num.
+func storeLine(num int, text string) error {
+	line, err := parseLine(num, text)
+	if err != nil {
+		return err
+	}
+	lines[num] = line
+	return nil
+}
+
+// parseLine ...
+// Parses text as line num, without storing it.
+func parseLine(num int, text string) (*Line, error) {
+	if num < 0 || MaxLines <= num {
+		return nil, fmt.Errorf("Line number %d isn't in range 0-%d", num, MaxLines)
+	}
+	line, err := MakeLine(text)
+	if err != nil {
+		return nil, fmt.Errorf("%d: %s", num, err.Error())
+	}
+	return line, nil
+}
+
+// sourceError ...
+// An error in line source of a file, which would have been line num of the
+// program
+type sourceError struct {
+	source int
+	num    int
+	err    error
+}
+
+func (e sourceError) Error() string {
+	return e.err.Error()
+}
+
+// reportParseErrors ...
+// Writes the errors from parsing the file name to w, each with the line of
+// the file it's on if it's a sourceError.
+func reportParseErrors(w io.Writer, name string, errs []error) {
+	for _, err := range errs {
+		if se, ok := err.(sourceError); ok {
+			fmt.Fprintf(w, "%s:%d: %s\n", name, se.source, err.Error())
+		} else {
+			fmt.Fprintf(w, "%s: %s\n", name, err.Error())
+		}
+	}
+}
+
+// lineError ...
+// An error on line index of a parsed program, such as a label declared twice
+type lineError struct {
+	index int
+	err   error
+}
+
+func (e lineError) Error() string {
+	return fmt.Sprintf("%d: %s", e.index, e.err.Error())
+}
+
+// parseProgram ...
+// Parses a program without storing it. Lines which don't start with a line
+// number are numbered automatically, AutoStep after the line before them; it's
+// an error for that number to be used by a numbered line as well.
+// Returns the lines, indexed by line number, and a sourceError for each line
+// that couldn't be parsed.
+func parseProgram(reader io.Reader) ([]*Line, []error) {
+	parsed := make([]*Line, MaxLines)
+	errs := []error{}
+	last := 0
+	// The source line each line number came from, explicitly or not
+	explicit := map[int]int{}
+	auto := map[int]int{}
+	source := 0
+
+	scanner := bufio.NewScanner(reader)
+	for scanner.Scan() {
+		source++
+		text := strings.TrimRight(scanner.Text(), "\r")
+		if strings.TrimSpace(text) == "" {
+			continue
+		}
+		words := strings.Split(text, " ")
+		if strings.ToUpper(words[0]) == "REM" {
+			continue
+		}
+
+		num, err := strconv.Atoi(words[0])
+		if err == nil {
+			text = strings.Join(words[1:], " ")
+			if from, ok := auto[num]; ok {
+				errs = append(errs, sourceError{source, num,
+					fmt.Errorf("%d: Line number is already used by the unnumbered line on line %d", num, from)})
+				continue
+			}
+			explicit[num] = source
+			last = num
+		} else {
+			num = last + AutoStep
+			last = num
+			if from, ok := explicit[num]; ok {
+				errs = append(errs, sourceError{source, num,
+					fmt.Errorf("%d: Unnumbered line would be numbered %d, which is already used by line %d",
+						num, num, from)})
+				continue
+			}
+			auto[num] = source
+		}
+
+		line, err := parseLine(num, text)
+		if err != nil {
+			errs = append(errs, sourceError{source, num, err})
+			continue
+		}
+		line.Source = source
+		parsed[num] = line
+	}
+
+	if err := scanner.Err(); err != nil {
+		errs = append(errs, err)
+	}
+	return parsed, errs
+}
+
+// loadProgram ...
+// Reads a program into lines, as parseProgram does. Returns the number of
+// lines loaded, and an error for each line that couldn't be.
+func loadProgram(reader io.Reader) (int, []error) {
+	parsed, errs := parseProgram(reader)
+	loaded := 0
+	for num, line := range parsed {
+		if line != nil {
+			lines[num] = line
+			loaded++
+		}
+	}
+	return loaded, errs
+}
+
+// clearProgram ...
+// Deletes every line of the program.
+func clearProgram() {
+	for i := range lines {
+		lines[i] = nil
+	}
+}
+
+// clearVars ...
+// Forgets all variables and DEF FN functions.
+func clearVars() {
+	stringVars = make(map[string]string)
+	intVars = make(map[string]int)
+	functions = make(map[string]*function)
+}
+
+// indexLabels ...
+// Finds the labels declared in the program.
+func indexLabels(lines []*Line) error {
+	labels = make(map[string]int)
+	for i, line := range lines {
+		if line == nil || !line.Used || line.Tokens[0].Type != TokenLabel {
+			continue
+		}
+		if prev, ok := labels[line.Tokens[0].StringData]; ok {
+			return lineError{i, fmt.Errorf("Label %s is already declared on line %d", line.Tokens[0].StringData, prev)}
+		}
+		labels[line.Tokens[0].StringData] = i
+	}
+	return nil
+}
@@ -0,0 +1,119 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// jumps ...
+// Returns the GOTO and GOSUB tokens in a line, including those after THEN and
+// ELSE.
+func jumps(l []Token) []Token {
+	ret := []Token{}
+	for _, token := range l {
+		if token.Type == TokenGoto || token.Type == TokenGosub {
+			ret = append(ret, token)
+		}
+	}
+	return ret
+}
+
+// renumber ...
+// Renumbers the lines from oldStart onwards, starting at start and counting up
+// by step, and rewrites the targets of GOTO and GOSUB to match. Returns the
+// number of lines renumbered, or an error explaining why it would be unsafe.
+func renumber(start, step, oldStart int) (int, error) {
+	if start < 0 || step <= 0 || oldStart < 0 {
+		return 0, fmt.Errorf("RENUM needs a positive start and increment")
+	}
+	if err := indexLabels(lines); err != nil {
+		return 0, err
+	}
+
+	mapping := make(map[int]int)
+	next := start
+	for i := oldStart; i < len(lines); i++ {
+		if lines[i] != nil && lines[i].Used {
+			mapping[i] = next
+			next += step
+		}
+	}
+	if len(mapping) == 0 {
+		return 0, nil
+	}
+	if next-step >= MaxLines {
+		return 0, fmt.Errorf("RENUM would need line numbers past %d", MaxLines-1)
+	}
+	for i := oldStart - 1; i >= 0; i-- {
+		if lines[i] != nil && lines[i].Used {
+			if start <= i {
+				return 0, fmt.Errorf("RENUM would overlap line %d, which isn't being renumbered", i)
+			}
+			break
+		}
+	}
+
+	problems := []string{}
+	for i, line := range lines {
+		if line == nil || !line.Used {
+			continue
+		}
+		for _, jump := range jumps(line.Tokens) {
+			if jump.StringData != "" {
+				if _, ok := labels[jump.StringData]; !ok {
+					problems = append(problems, fmt.Sprintf("%d: %s uses a computed line number", i, jump.String()))
+				}
+			} else if _, ok := mapping[jump.IntData]; !ok && jump.IntData >= oldStart {
+				problems = append(problems, fmt.Sprintf("%d: %s jumps to a line that doesn't exist", i, jump.String()))
+			}
+		}
+	}
+	if len(problems) > 0 {
+		return 0, fmt.Errorf("RENUM can't safely renumber this program:\n%s", strings.Join(problems, "\n"))
+	}
+
+	renumbered := make([]*Line, MaxLines)
+	for i, line := range lines {
+		if line == nil || !line.Used {
+			continue
+		}
+		content := renumberContent(line.Content, mapping)
+		newline, err := MakeLine(content)
+		if err != nil {
+			return 0, fmt.Errorf("%d: %s", i, err.Error())
+		}
+		newline.Source = line.Source
+		if newindex, ok := mapping[i]; ok {
+			renumbered[newindex] = newline
+		} else {
+			renumbered[i] = newline
+		}
+	}
+	copy(lines, renumbered)
+	renumberBreakpoints(mapping, oldStart)
+	return len(mapping), nil
+}
+
+// renumberContent ...
+// Rewrites the line numbers after GOTO and GOSUB in the text of a line.
+func renumberContent(content string, mapping map[int]int) string {
+	words := strings.Split(content, " ")
+	quoted := false
+	for i, word := range words {
+		if !quoted && i+1 < len(words) {
+			kw := strings.ToUpper(word)
+			if kw == "GOTO" || kw == "GOSUB" {
+				if num, err := strconv.Atoi(words[i+1]); err == nil {
+					if newnum, ok := mapping[num]; ok {
+						words[i+1] = strconv.Itoa(newnum)
+					}
+				}
+			}
+		}
+		if strings.Count(word, "\"")%2 == 1 {
+			quoted = !quoted
+		}
+	}
+	return strings.Join(words, " ")
+}
@@ -0,0 +1,250 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// HistoryFile ...
+// Name of the file in the home directory where the REPL keeps its history
+const HistoryFile string = ".ez_history"
+
+// commands ...
+// The commands understood by the REPL, as well as the statements
+var commands = []string{
+	"AUTO", "BREAK", "CONT", "DEBUG", "DELETE", "EDIT", "EXIT", "LIST", "LISTDEBUG", "LOAD", "LOADSTATE", "MERGE",
+	"NEW", "NEXT", "RENUM", "RUN", "SAVE", "SAVESTATE", "STEP", "UNBREAK", "UNWATCH", "VARS", "WATCH", "WHERE",
+	"XREF",
+}
+
+// prefill ...
+// Text to put in the line editor the next time the REPL reads a line
+var prefill string
+
+// completions ...
+// Returns the keywords, commands and variable names which could complete word.
+func completions(word string) []string {
+	ret := []string{}
+	seen := make(map[string]bool)
+	add := func(candidate, prefix string) {
+		if strings.HasPrefix(candidate, prefix) && !seen[candidate] {
+			seen[candidate] = true
+			ret = append(ret, candidate)
+		}
+	}
+
+	// Some words, such as EXIT, are both keywords and commands
+	upper := strings.ToUpper(word)
+	for _, kw := range keywords {
+		add(kw, upper)
+	}
+	for _, kw := range commands {
+		add(kw, upper)
+	}
+	for name := range intVars {
+		add(name, word)
+	}
+	for name := range stringVars {
+		add(name, word)
+	}
+	sort.Strings(ret)
+	return ret
+}
+
+// reportPanic ...
+// Deferred by command, so that a bug in ez prints an error instead of ending
+// the session.
+func reportPanic() {
+	if r := recover(); r != nil {
+		fmt.Println(panicError{r}.Error())
+	}
+}
+
+// command ...
+// Handles a line typed at the REPL: either a command, a numbered line to store
+// in the program, or a statement to run straight away.
+func command(text string) {
+	defer reportPanic()
+	if text == "" {
+		return
+	}
+	words := strings.Split(text, " ")
+	kw := strings.ToUpper(words[0])
+
+	// A paused program can't be continued once it's been changed
+	switch kw {
+	case "AUTO", "DELETE", "LOAD", "LOADSTATE", "MERGE", "NEW", "RENUM":
+		abortExecution()
+	}
+
+	switch kw {
+	case "EXIT":
+		if len(words) == 1 {
+			os.Exit(0)
+		}
+	case "RUN":
+		startExecution(stepNone)
+		return
+	case "CONT":
+		continueExecution(stepNone)
+		return
+	case "STEP":
+		continueExecution(stepInto)
+		return
+	case "NEXT":
+		continueExecution(stepOver)
+		return
+	case "BREAK":
+		breakCommand(words[1:], true)
+		return
+	case "UNBREAK":
+		breakCommand(words[1:], false)
+		return
+	case "WATCH":
+		watchCommand(words[1:], true)
+		return
+	case "UNWATCH":
+		watchCommand(words[1:], false)
+		return
+	case "WHERE":
+		whereCommand()
+		return
+	case "DEBUG":
+		debugCommand(words[1:])
+		return
+	case "REM":
+		return
+	case "LISTDEBUG":
+		listLinesDebug()
+		return
+	case "LIST":
+		listCommand(words[1:])
+		return
+	case "VARS":
+		fmt.Println("Strings:", stringVars, "Integers:", intVars)
+		return
+	case "XREF":
+		xrefCommand()
+		return
+	case "RENUM":
+		renumCommand(words[1:])
+		return
+	case "SAVE":
+		saveCommand(words[1:])
+		return
+	case "LOAD":
+		loadCommand(words[1:], false)
+		return
+	case "SAVESTATE":
+		saveStateCommand(words[1:])
+		return
+	case "LOADSTATE":
+		loadStateCommand(words[1:])
+		return
+	case "MERGE":
+		loadCommand(words[1:], true)
+		return
+	case "NEW":
+		clearProgram()
+		clearVars()
+		return
+	case "DELETE":
+		deleteCommand(words[1:])
+		return
+	case "EDIT":
+		editCommand(words[1:])
+		return
+	case "AUTO":
+		autoCommand(words[1:])
+		return
+	}
+
+	num, err := strconv.Atoi(words[0])
+	if err == nil {
+		abortExecution()
+		err = storeLine(num, strings.Join(words[1:], " "))
+		if err != nil {
+			fmt.Println(err.Error())
+		}
+		return
+	}
+
+	line, err := MakeLine(text)
+	if err != nil {
+		fmt.Println(err.Error())
+		return
+	}
+	err = execImmediate(line)
+	if err != nil && err != errEnd {
+		fmt.Println(err.Error())
+	}
+}
+
+// isScript ...
+// Reports whether a file uses REPL commands, such as RUN, rather than being
+// just a program. EXIT is a statement as well, so it doesn't count.
+func isScript(src []byte) bool {
+	for _, text := range strings.Split(string(src), "\n") {
+		kw := strings.ToUpper(strings.Split(strings.TrimSpace(text), " ")[0])
+		for _, c := range commands {
+			if kw == c && kw != "EXIT" {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// runScript ...
+// Handles each line of a file as if it had been typed at the REPL, as ez did
+// with every file before it could load programs without line numbers.
+func runScript(src []byte) {
+	for _, text := range strings.Split(string(src), "\n") {
+		command(strings.TrimSpace(text))
+	}
+}
+
+// promptLine ...
+// Reads a line for the REPL, showing prompt, with initial already typed in.
+// Without a line editor, initial is shown on the line above instead.
+var promptLine = func(prompt, initial string) (string, error) {
+	if initial != "" {
+		fmt.Println(initial)
+	}
+	fmt.Print(prompt)
+	return readInputLine()
+}
+
+// repl ...
+// Reads and handles lines from standard input until it runs out. On a
+// terminal, lines are read with the line editor.
+func repl() {
+	if isTerminal(os.Stdin) {
+		histPath := ""
+		if home, err := os.UserHomeDir(); err == nil {
+			histPath = filepath.Join(home, HistoryFile)
+		}
+		promptLine = newLineEditor(histPath, completions).readLine
+		watchInterrupts()
+	}
+
+	for {
+		initial := prefill
+		prefill = ""
+		text, err := promptLine("", initial)
+		if err == io.EOF {
+			return
+		} else if err == errInterrupted {
+			continue
+		} else if err != nil {
+			fmt.Fprintln(os.Stderr, err.Error())
+			os.Exit(1)
+		}
+		command(text)
+	}
+}
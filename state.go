@@ -0,0 +1,317 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+)
+
+// StateVersion ...
+// Version of the format written by SAVESTATE. LOADSTATE refuses files with
+// any other version.
+const StateVersion int = 1
+
+// snapshot ...
+// Everything SAVESTATE saves: the program, the variables and DEF FN
+// functions, and if the program is paused, where, and the calls it's inside.
+type snapshot struct {
+	Version   int               `json:"version"`
+	Lines     []snapshotLine    `json:"lines"`
+	Ints      map[string]int    `json:"ints"`
+	Strs      map[string]string `json:"strs"`
+	Functions []string          `json:"functions"`
+	Tracing   bool              `json:"tracing"`
+	TraceVars bool              `json:"traceVars"`
+	Paused    bool              `json:"paused"`
+	Index     int               `json:"index"`
+	Calls     []snapshotFrame   `json:"calls"`
+	Scopes    []snapshotScope   `json:"scopes"`
+}
+
+// snapshotLine ...
+// A line of the program, as it was typed
+type snapshotLine struct {
+	Number int    `json:"number"`
+	Text   string `json:"text"`
+}
+
+// snapshotFrame ...
+// A frame of the call stack. Scope is the index of its scope in the
+// snapshot's Scopes, or -1 for a GOSUB.
+type snapshotFrame struct {
+	Name  string `json:"name"`
+	Ret   int    `json:"ret"`
+	From  int    `json:"from"`
+	Scope int    `json:"scope"`
+}
+
+// snapshotScope ...
+// The local variables of a SUB or FUNCTION call
+type snapshotScope struct {
+	Ints map[string]int         `json:"ints"`
+	Strs map[string]string      `json:"strs"`
+	Refs map[string]snapshotRef `json:"refs"`
+}
+
+// snapshotRef ...
+// A BYREF parameter, referring to a variable in the scope with index Scope,
+// or a global if it's -1
+type snapshotRef struct {
+	Scope int    `json:"scope"`
+	Name  string `json:"name"`
+}
+
+// takeSnapshot ...
+// Captures the state of the session. A program paused inside a FUNCTION
+// called from an expression can't be saved, since it's part way through the
+// expression.
+func takeSnapshot() (*snapshot, error) {
+	snap := &snapshot{Version: StateVersion, Lines: []snapshotLine{}, Ints: intVars, Strs: stringVars,
+		Functions: []string{}, Tracing: tracing, TraceVars: traceVars, Calls: []snapshotFrame{},
+		Scopes: []snapshotScope{}}
+	for i, line := range lines {
+		if line != nil && line.Used {
+			snap.Lines = append(snap.Lines, snapshotLine{i, line.Content})
+		}
+	}
+
+	names := []string{}
+	for name := range functions {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		fn := functions[name]
+		l := []Token{{Type: TokenDef, StringData: name}}
+		for i, param := range fn.params {
+			if i > 0 {
+				l = append(l, Token{Type: TokenComma})
+			}
+			l = append(l, param)
+		}
+		l = append(append(l, Token{Type: TokenEq}), fn.body...)
+		snap.Functions = append(snap.Functions, formatTokens(l))
+	}
+
+	if current == nil {
+		return snap, nil
+	}
+	snap.Paused = true
+	snap.Index = current.index
+	if current.reason == reasonStop {
+		// STOP carries on with the line after it
+		if snap.Index = nextUsed(lines, current.index); snap.Index == -1 {
+			snap.Index = len(lines)
+		}
+	}
+
+	scopeIndex := map[*scope]int{nil: -1}
+	for i, s := range scopes {
+		scopeIndex[s] = i
+	}
+	for _, f := range callStack {
+		if f.ret == -1 {
+			return nil, fmt.Errorf("Can't save the state inside %s, which was called from an expression", f.name)
+		}
+		snap.Calls = append(snap.Calls, snapshotFrame{f.name, f.ret, f.from, scopeIndex[f.scope]})
+	}
+	for _, s := range scopes {
+		refs := make(map[string]snapshotRef)
+		for name, r := range s.refs {
+			refs[name] = snapshotRef{scopeIndex[r.s], r.name}
+		}
+		snap.Scopes = append(snap.Scopes, snapshotScope{s.ints, s.strs, refs})
+	}
+	return snap, nil
+}
+
+// writeState ...
+// Writes the state of the session to w.
+func writeState(w io.Writer) error {
+	snap, err := takeSnapshot()
+	if err != nil {
+		return err
+	}
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(snap)
+}
+
+// readState ...
+// Reads a snapshot written by writeState, and checks that it makes sense,
+// without changing anything. Returns the snapshot and its program.
+func readState(r io.Reader) (*snapshot, []*Line, error) {
+	snap := &snapshot{}
+	if err := json.NewDecoder(r).Decode(snap); err != nil {
+		return nil, nil, fmt.Errorf("Not a saved state: %s", err.Error())
+	}
+	if snap.Version != StateVersion {
+		return nil, nil, fmt.Errorf("Saved state has version %d, but this version of ez reads version %d",
+			snap.Version, StateVersion)
+	}
+
+	prog := make([]*Line, MaxLines)
+	for _, l := range snap.Lines {
+		line, err := parseLine(l.Number, l.Text)
+		if err != nil {
+			return nil, nil, err
+		}
+		prog[l.Number] = line
+	}
+	for _, text := range snap.Functions {
+		if line, err := MakeLine(text); err != nil || !line.Used || line.Tokens[0].Type != TokenDef {
+			return nil, nil, fmt.Errorf("Bad function in saved state: %s", text)
+		}
+	}
+
+	if !snap.Paused {
+		return snap, prog, nil
+	}
+	if snap.Index < 0 || MaxLines < snap.Index {
+		return nil, nil, fmt.Errorf("Saved state is paused at line %d, which isn't in range 0-%d", snap.Index, MaxLines)
+	}
+	procs, err := findProcedures(prog)
+	if err != nil {
+		return nil, nil, err
+	}
+	for _, f := range snap.Calls {
+		if f.Scope < -1 || len(snap.Scopes) <= f.Scope {
+			return nil, nil, fmt.Errorf("Bad call to %s in saved state", f.Name)
+		}
+		// Calls from expressions are never saved, so -1 isn't allowed either
+		if f.Ret < 0 || MaxLines < f.Ret || f.From < 0 || MaxLines < f.From {
+			return nil, nil, fmt.Errorf("Saved state has a call to %s from line %d returning to line %d, "+
+				"which aren't in range 0-%d", f.Name, f.From, f.Ret, MaxLines)
+		}
+		if _, ok := procs[f.Name]; f.Scope != -1 && !ok {
+			return nil, nil, fmt.Errorf("Saved state is inside %s, which isn't in the program", f.Name)
+		}
+	}
+	for _, s := range snap.Scopes {
+		for _, r := range s.Refs {
+			if r.Scope < -1 || len(snap.Scopes) <= r.Scope {
+				return nil, nil, fmt.Errorf("Bad reference to %s in saved state", r.Name)
+			}
+		}
+	}
+	return snap, prog, nil
+}
+
+// restoreState ...
+// Replaces the program and variables with those in snap, and if it was
+// paused, pauses the program where it was.
+func restoreState(snap *snapshot, prog []*Line) error {
+	abortExecution()
+	copy(lines, prog)
+	clearVars()
+	for name, i := range snap.Ints {
+		intVars[name] = i
+	}
+	for name, s := range snap.Strs {
+		stringVars[name] = s
+	}
+	for _, text := range snap.Functions {
+		line, _ := MakeLine(text)
+		defineFunction(line.Tokens)
+	}
+	tracing, traceVars = snap.Tracing, snap.TraceVars
+	if !snap.Paused {
+		return nil
+	}
+
+	if err := prepareRun(); err != nil {
+		return err
+	}
+	restored := make([]*scope, len(snap.Scopes))
+	for i := range snap.Scopes {
+		restored[i] = newScope()
+	}
+	for i, s := range snap.Scopes {
+		for name, v := range s.Ints {
+			restored[i].ints[name] = v
+		}
+		for name, v := range s.Strs {
+			restored[i].strs[name] = v
+		}
+		for name, r := range s.Refs {
+			target := ref{name: r.Name}
+			if r.Scope != -1 {
+				target.s = restored[r.Scope]
+			}
+			restored[i].refs[name] = target
+		}
+	}
+	scopes = restored
+	for _, f := range snap.Calls {
+		call := &frame{name: f.Name, ret: f.Ret, from: f.From}
+		if f.Scope != -1 {
+			call.proc = procedures[f.Name]
+			call.scope = restored[f.Scope]
+		}
+		callStack = append(callStack, call)
+	}
+	restoreExecution(snap.Index)
+	return nil
+}
+
+// saveStateCommand ...
+// SAVESTATE "file" saves the program, its variables, and where it's paused,
+// so that LOADSTATE can pick up from there later.
+func saveStateCommand(args []string) {
+	name, err := fileArg(args)
+	if err != nil {
+		fmt.Println(err.Error())
+		return
+	}
+	file, err := os.Create(name)
+	if err != nil {
+		fmt.Println(err.Error())
+		return
+	}
+	err = writeState(file)
+	if cerr := file.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		fmt.Println(err.Error())
+		os.Remove(name)
+	}
+}
+
+// loadState ...
+// Reads the state saved in the file name and restores it.
+func loadState(name string) error {
+	file, err := os.Open(name)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	snap, prog, err := readState(file)
+	if err != nil {
+		return err
+	}
+	if err := restoreState(snap, prog); err != nil {
+		return err
+	}
+	if snap.Paused {
+		fmt.Printf("Loaded %d lines, paused before line %d; CONT to carry on\n", len(snap.Lines), snap.Index)
+	} else {
+		fmt.Printf("Loaded %d lines\n", len(snap.Lines))
+	}
+	return nil
+}
+
+// loadStateCommand ...
+// LOADSTATE "file" replaces the program and variables with those saved by
+// SAVESTATE.
+func loadStateCommand(args []string) {
+	name, err := fileArg(args)
+	if err == nil {
+		err = loadState(name)
+	}
+	if err != nil {
+		fmt.Println(err.Error())
+	}
+}
@@ -0,0 +1,21 @@
+//go:build !linux
+
+package main
+
+import (
+	"fmt"
+	"os"
+)
+
+// terminalHeight ...
+// Returns the number of rows in the terminal f, or 0 if it can't be found.
+func terminalHeight(f *os.File) int {
+	return 0
+}
+
+// makeRaw ...
+// Raw mode isn't supported on this platform, so the line editor falls back to
+// reading whole lines.
+func makeRaw(f *os.File) (func(), error) {
+	return nil, fmt.Errorf("Raw mode isn't supported on this platform")
+}
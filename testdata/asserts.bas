@@ -0,0 +1,34 @@
+REM The program itself, checked against asserts.out
+LET a = 3 ; b = 4
+CALL swap(a, b)
+PRINT a " " b
+ASSERT a = 4
+ASSERT b = 4, "b should be " + "4"
+PRINT "not reached"
+END
+
+SUB swap(BYREF x, BYREF y)
+  LOCAL t
+  LET t = x ; x = y ; y = t
+END SUB
+
+FUNCTION max(x, y)
+  IF x > y THEN LET max = x ELSE LET max = y
+END FUNCTION
+
+TEST "swap"
+  LET a = 1 ; b = 2
+  CALL swap(a, b)
+  ASSERT a = 2
+  ASSERT b = 1
+END TEST
+
+TEST "max"
+  ASSERT max(1, 2) = 2
+  ASSERT max(5, -5) = 5, "max(5, -5) should be 5"
+END TEST
+
+TEST "no variables"
+  ASSERT a = 0
+  ASSERT t$ = ""
+END TEST
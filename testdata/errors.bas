@@ -0,0 +1,3 @@
+PRINT "before"
+LET x = 1 + "a"
+PRINT "after"
@@ -0,0 +1,9 @@
+LET i = 0
+top:
+LET i + 1
+GOSUB show
+IF i < 3 THEN GOTO top
+END
+show:
+PRINT "i = " i
+RETURN
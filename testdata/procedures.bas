@@ -0,0 +1,11 @@
+10 LET a = 3 ; b = 4
+20 CALL swap(a, b)
+30 PRINT a " " b " " fact(a)
+40 END
+100 SUB swap(BYREF x, BYREF y)
+110 LOCAL t
+120 LET t = x ; x = y ; y = t
+130 END SUB
+200 FUNCTION fact(n)
+210 IF n <= 1 THEN LET fact = 1 ELSE LET fact = n * fact(n - 1)
+220 END FUNCTION
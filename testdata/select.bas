@@ -0,0 +1,10 @@
+10 INPUT "Continue? " a$
+20 SELECT CASE a$
+30 CASE "y", "Y"
+40 PRINT "Carrying on"
+50 CASE "n", "N"
+60 PRINT "Stopping"
+70 END
+80 CASE ELSE
+90 GOTO 10
+100 END SELECT
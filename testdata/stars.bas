@@ -0,0 +1,15 @@
+10 INPUT "What is your name? " u$
+20 PRINT "Hello " u$
+30 INPUT "How many stars do you want? " n
+40 LET s$ = ""
+50 LET i = 1
+60 LET s$ = s$ + "*"
+70 LET i = i + 1
+80 IF i <= n THEN GOTO 60
+90 PRINT s$
+100 INPUT "Do you want more stars? " a$
+110 IF a$ = 0 THEN GOTO 100
+120 IF a$ = "Y" THEN GOTO 30
+130 IF a$ = "y" THEN GOTO 30
+140 PRINT "Goodbye " u$
+150 END
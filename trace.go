@@ -0,0 +1,25 @@
+package main
+
+import (
+	"fmt"
+)
+
+// tracing is turned on by TRON or --trace, and traceVars by TRON VARS or
+// --trace-vars
+var tracing, traceVars bool
+
+// traceLine ...
+// Shows that line index is about to run.
+func traceLine(index int) {
+	if tracing {
+		fmt.Fprintf(output, "[%d]\n", index)
+	}
+}
+
+// traceWrite ...
+// Shows a value being assigned to a variable by the program.
+func traceWrite(name string, v value) {
+	if tracing && traceVars && currentLine >= 0 {
+		fmt.Fprintf(output, "[%d] %s <- %s\n", currentLine, name, v.literal())
+	}
+}
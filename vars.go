@@ -0,0 +1,140 @@
+package main
+
+import (
+	"fmt"
+)
+
+// MaxCallDepth ...
+// Maximum number of nested function calls
+const MaxCallDepth int = 256
+
+// scope ...
+// Variables local to a function call. These shadow the global variables of
+// the same name for as long as the call lasts.
+type scope struct {
+	ints map[string]int
+	strs map[string]string
+	refs map[string]ref
+}
+
+// ref ...
+// A by-reference parameter; refers to a variable in another scope, or to a
+// global if s is nil.
+type ref struct {
+	s    *scope
+	name string
+}
+
+var scopes []*scope
+
+func newScope() *scope {
+	return &scope{
+		ints: make(map[string]int),
+		strs: make(map[string]string),
+		refs: make(map[string]ref),
+	}
+}
+
+func pushScope(s *scope) error {
+	if len(scopes) >= MaxCallDepth {
+		return fmt.Errorf("Too many nested calls (maximum %d)", MaxCallDepth)
+	}
+	scopes = append(scopes, s)
+	return nil
+}
+
+func popScope() {
+	scopes = scopes[:len(scopes)-1]
+}
+
+// resolve ...
+// Finds the variable that an identifier refers to in the current scope.
+func resolve(t Token) ref {
+	if len(scopes) == 0 {
+		return ref{name: t.StringData}
+	}
+	s := scopes[len(scopes)-1]
+	if r, ok := s.refs[t.StringData]; ok {
+		return r
+	}
+	if _, ok := s.ints[t.StringData]; ok && t.Type == TokenIdentInt {
+		return ref{s: s, name: t.StringData}
+	}
+	if _, ok := s.strs[t.StringData]; ok && t.Type == TokenIdentStr {
+		return ref{s: s, name: t.StringData}
+	}
+	return ref{name: t.StringData}
+}
+
+func getInt(name string) int {
+	r := resolve(Token{Type: TokenIdentInt, StringData: name})
+	if r.s == nil {
+		return intVars[r.name]
+	}
+	return r.s.ints[r.name]
+}
+
+func setInt(name string, i int) {
+	traceWrite(name, value{i: i})
+	r := resolve(Token{Type: TokenIdentInt, StringData: name})
+	if r.s == nil {
+		intVars[r.name] = i
+	} else {
+		r.s.ints[r.name] = i
+	}
+}
+
+func getStr(name string) string {
+	r := resolve(Token{Type: TokenIdentStr, StringData: name})
+	if r.s == nil {
+		return stringVars[r.name]
+	}
+	return r.s.strs[r.name]
+}
+
+func setStr(name string, s string) {
+	traceWrite(name, value{isStr: true, s: s})
+	r := resolve(Token{Type: TokenIdentStr, StringData: name})
+	if r.s == nil {
+		stringVars[r.name] = s
+	} else {
+		r.s.strs[r.name] = s
+	}
+}
+
+// declareLocal ...
+// Creates a variable in the current scope, hiding any global of the same name.
+func declareLocal(t Token) error {
+	if len(scopes) == 0 {
+		return fmt.Errorf("LOCAL can only be used inside a SUB or FUNCTION")
+	}
+	s := scopes[len(scopes)-1]
+	if t.Type == TokenIdentInt {
+		if _, ok := s.ints[t.StringData]; !ok {
+			s.ints[t.StringData] = 0
+		}
+	} else if _, ok := s.strs[t.StringData]; !ok {
+		s.strs[t.StringData] = ""
+	}
+	return nil
+}
+
+// setVar ...
+// Assigns v to the variable named by the identifier token t, checking types.
+func setVar(t Token, v value) error {
+	switch t.Type {
+	case TokenIdentInt:
+		if v.isStr {
+			return fmt.Errorf("Cannot assign a string to integer variable %s", t.StringData)
+		}
+		setInt(t.StringData, v.i)
+	case TokenIdentStr:
+		if !v.isStr {
+			return fmt.Errorf("Cannot assign an integer to string variable %s", t.StringData)
+		}
+		setStr(t.StringData, v.s)
+	default:
+		return fmt.Errorf("Not an identifier: %s", t.String())
+	}
+	return nil
+}
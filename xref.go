@@ -0,0 +1,247 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+)
+
+// references ...
+// The lines which read and write a variable, or which GOTO and GOSUB a line
+type references struct {
+	read, written []int
+	gotos, gosubs []int
+}
+
+// crossReference ...
+// The result of xref: every variable, every line jumped to, and the lines with
+// a computed GOTO or GOSUB, which could jump anywhere
+type crossReference struct {
+	vars     map[string]*references
+	targets  map[int]*references
+	computed []int
+}
+
+// addIndex ...
+// Adds index to refs, unless it's already the last line there.
+func addIndex(refs []int, index int) []int {
+	if len(refs) > 0 && refs[len(refs)-1] == index {
+		return refs
+	}
+	return append(refs, index)
+}
+
+// xref ...
+// Finds the lines which read and write each variable in a program, and the
+// lines which jump to each line. A variable passed to a BYREF parameter counts
+// as written, and the parameters of a SUB, FUNCTION or DEF FN are written by
+// the line defining it. Uses indexProcedures and indexLabels, so the program
+// must have been parsed successfully. XREF can be used while a program is
+// paused, so the procedures and labels it's using are put back afterwards.
+func xref(prog []*Line) (*crossReference, error) {
+	savedProcedures, savedLabels := procedures, labels
+	defer func() { procedures, labels = savedProcedures, savedLabels }()
+	if err := indexProcedures(prog); err != nil {
+		return nil, err
+	}
+	if err := indexLabels(prog); err != nil {
+		return nil, err
+	}
+
+	x := &crossReference{vars: make(map[string]*references), targets: make(map[int]*references)}
+	variable := func(name string) *references {
+		r, ok := x.vars[name]
+		if !ok {
+			r = &references{}
+			x.vars[name] = r
+		}
+		return r
+	}
+	target := func(index int) *references {
+		r, ok := x.targets[index]
+		if !ok {
+			r = &references{}
+			x.targets[index] = r
+		}
+		return r
+	}
+
+	for i, line := range prog {
+		if line == nil || !line.Used {
+			continue
+		}
+		access := func(t Token, write bool) {
+			if write {
+				variable(t.StringData).written = addIndex(variable(t.StringData).written, i)
+			} else {
+				variable(t.StringData).read = addIndex(variable(t.StringData).read, i)
+			}
+		}
+
+		for _, l := range statements(line.Tokens) {
+			switch l[0].Type {
+			case TokenIf:
+				thenPos, _ := ifParts(l)
+				variables(l[1:thenPos], access)
+			case TokenLet:
+				for _, clause := range letClauses(l) {
+					if len(clause) > 1 && clause[1].Type == TokenEq {
+						variables(clause[2:], access)
+					} else if len(clause) > 1 {
+						variables(clause, access)
+					}
+					if len(clause) > 1 {
+						access(clause[0], true)
+					}
+				}
+			case TokenInput:
+				variables(l[1:2], access)
+				access(l[2], true)
+			case TokenLocal, TokenSubroutine, TokenFunction:
+				for _, t := range l[1:] {
+					if t.Type == TokenIdentInt || t.Type == TokenIdentStr {
+						access(t, true)
+					}
+				}
+			case TokenGoto, TokenGosub:
+				to, ok := l[0].IntData, true
+				if l[0].StringData != "" {
+					to, ok = labels[l[0].StringData]
+				}
+				if !ok {
+					access(Token{Type: TokenIdentInt, StringData: l[0].StringData}, false)
+					x.computed = addIndex(x.computed, i)
+				} else if l[0].Type == TokenGoto {
+					target(to).gotos = addIndex(target(to).gotos, i)
+				} else {
+					target(to).gosubs = addIndex(target(to).gosubs, i)
+				}
+			case TokenCallSub:
+				variables([]Token{{Type: TokenCall, StringData: l[0].StringData, Args: l[0].Args}}, access)
+			case TokenDef:
+				eqPos := 1
+				for l[eqPos].Type != TokenEq {
+					if l[eqPos].Type != TokenComma {
+						access(l[eqPos], true)
+					}
+					eqPos++
+				}
+				variables(l[eqPos+1:], access)
+			default:
+				variables(l[1:], access)
+			}
+		}
+	}
+	return x, nil
+}
+
+func joinInts(l []int) string {
+	strs := make([]string, len(l))
+	for i, n := range l {
+		strs[i] = strconv.Itoa(n)
+	}
+	return strings.Join(strs, " ")
+}
+
+// writeXref ...
+// Writes the variables in the cross reference in alphabetical order, then
+// the lines jumped to in order. Lines jumped to which don't exist are marked.
+func writeXref(w io.Writer, prog []*Line, x *crossReference) error {
+	var buf bytes.Buffer
+	tw := tabwriter.NewWriter(&buf, 0, 0, 2, ' ', 0)
+	names := []string{}
+	for name := range x.vars {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	if len(names) > 0 {
+		fmt.Fprintln(tw, "VARIABLE\tREAD BY\tWRITTEN BY")
+	}
+	for _, name := range names {
+		fmt.Fprintf(tw, "%s\t%s\t%s\n", name, joinInts(x.vars[name].read), joinInts(x.vars[name].written))
+	}
+	tw.Flush()
+
+	indexes := []int{}
+	for index := range x.targets {
+		indexes = append(indexes, index)
+	}
+	sort.Ints(indexes)
+	if len(names) > 0 && len(indexes) > 0 {
+		fmt.Fprintln(&buf)
+	}
+	if len(indexes) > 0 {
+		fmt.Fprintln(tw, "LINE\tGOTO FROM\tGOSUB FROM")
+	}
+	for _, index := range indexes {
+		missing := ""
+		if prog[index] == nil || !prog[index].Used {
+			missing = " (doesn't exist)"
+		}
+		fmt.Fprintf(tw, "%d%s\t%s\t%s\n", index, missing, joinInts(x.targets[index].gotos),
+			joinInts(x.targets[index].gosubs))
+	}
+	tw.Flush()
+
+	if len(x.computed) > 0 {
+		fmt.Fprintf(&buf, "\nComputed GOTO or GOSUB, which could jump to any line: %s\n", joinInts(x.computed))
+	}
+
+	// Empty columns at the end of a row leave trailing spaces
+	if buf.Len() == 0 {
+		return nil
+	}
+	for _, line := range strings.Split(strings.TrimSuffix(buf.String(), "\n"), "\n") {
+		if _, err := io.WriteString(w, strings.TrimRight(line, " ")+"\n"); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// xrefCommand ...
+// XREF lists the variables in the program with the lines which read and write
+// them, and the lines jumped to with the lines which jump there.
+func xrefCommand() {
+	x, err := xref(lines)
+	if err == nil {
+		err = writeXref(os.Stdout, lines, x)
+	}
+	if err != nil {
+		fmt.Println(err.Error())
+	}
+}
+
+// xrefFileCommand ...
+// ez xref file does the same as XREF, for a program in a file.
+func xrefFileCommand(args []string) {
+	if len(args) != 1 {
+		fmt.Fprintln(os.Stderr, "Usage: ez xref file")
+		os.Exit(2)
+	}
+	file, err := os.Open(args[0])
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err.Error())
+		os.Exit(1)
+	}
+	prog, errs := parseProgram(file)
+	file.Close()
+	reportParseErrors(os.Stderr, args[0], errs)
+	if len(errs) > 0 {
+		os.Exit(1)
+	}
+
+	x, err := xref(prog)
+	if err == nil {
+		err = writeXref(os.Stdout, prog, x)
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err.Error())
+		os.Exit(1)
+	}
+}